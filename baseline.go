@@ -0,0 +1,83 @@
+// This file contains the utility methods for comparing benchmark results against
+// those of a previous run, allowing hive to act as a performance gate.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// benchmarkComparison is the outcome of comparing a benchmark result against the
+// matching entry of the baseline run.
+type benchmarkComparison struct {
+	Status  string  `json:"status"`          // Outcome of the comparison (new, ok or regression)
+	NsPerOp int64   `json:"ns/op,omitempty"` // Nanoseconds spent per single iteration in the baseline
+	Delta   float64 `json:"delta,omitempty"` // Change of the time per iteration relative to the baseline, in percent
+}
+
+// benchmarkBaseline is the time spent per iteration of every benchmark in the
+// baseline run, keyed by client (and sync mode) and benchmark name.
+type benchmarkBaseline map[string]map[string]int64
+
+// loadBenchmarkBaseline reads the benchmark results of a previous run, either as
+// a full hive result file or as its bare benchmarks section. Benchmarks that did
+// not succeed in the baseline run are dropped, as they have nothing to compare to.
+func loadBenchmarkBaseline(path string) (benchmarkBaseline, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	type baselineResult struct {
+		Success bool  `json:"success"`
+		NsPerOp int64 `json:"ns/op"`
+	}
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(blob, &sections); err != nil {
+		return nil, fmt.Errorf("invalid benchmark baseline %s: %v", path, err)
+	}
+	if section, ok := sections["benchmarks"]; ok {
+		blob = section
+	}
+	var results map[string]map[string]*baselineResult
+	if err := json.Unmarshal(blob, &results); err != nil {
+		return nil, fmt.Errorf("invalid benchmark baseline %s: %v", path, err)
+	}
+	baseline := make(benchmarkBaseline)
+	for client, benchmarks := range results {
+		for name, result := range benchmarks {
+			if result == nil || !result.Success || result.NsPerOp <= 0 {
+				continue
+			}
+			if baseline[client] == nil {
+				baseline[client] = make(map[string]int64)
+			}
+			baseline[client][name] = result.NsPerOp
+		}
+	}
+	return baseline, nil
+}
+
+// compare checks a finished benchmark against its baseline entry. Benchmarks
+// missing from the baseline are reported as new, the ones slower than the baseline
+// by more than threshold percent as regressions. Failed benchmarks have nothing to
+// compare, so nil is returned for them.
+func (b benchmarkBaseline) compare(client string, name string, result *benchmarkResult, threshold float64) *benchmarkComparison {
+	if !result.Success || result.NsPerOp <= 0 {
+		return nil
+	}
+	base, ok := b[client][name]
+	if !ok {
+		return &benchmarkComparison{Status: "new"}
+	}
+	comparison := &benchmarkComparison{
+		Status:  "ok",
+		NsPerOp: base,
+		Delta:   float64(result.NsPerOp-base) / float64(base) * 100,
+	}
+	if comparison.Delta > threshold {
+		comparison.Status = "regression"
+	}
+	return comparison
+}
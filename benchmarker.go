@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -25,7 +29,13 @@ type benchmarkResult struct {
 	Error      error     `json:"error,omitempty"`      // Potential hive failure during benchmark
 	Iterations int       `json:"iterations,omitempty"` // Number of benchmark iterations made
 	NsPerOp    int64     `json:"ns/op,omitempty"`      // Nanoseconds spend per single iteration
+	Ulimits    string    `json:"ulimits,omitempty"`    // Resource limits the containers ran with
+	Resources  string    `json:"resources,omitempty"`  // Memory and CPU limits the client ran with
+	SyncMode   string    `json:"syncMode,omitempty"`   // Sync mode the client ran in, if explicitly requested
 
+	TruncatedLogs []string `json:"truncatedLogs,omitempty"` // Captured logs that exceeded the size cap and lost their heads
+
+	Baseline *benchmarkComparison `json:"baseline,omitempty"` // Comparison against the -bench-baseline run, if requested
 }
 
 type benchmarkResultSummary struct {
@@ -34,8 +44,9 @@ type benchmarkResultSummary struct {
 }
 
 // benchmarkClients runs a batch of benchmark tests matched by benchmarkerPattern
-// against all clients matching clientPattern.
-func benchmarkClients(daemon *docker.Client, clientPattern, benchmarkerPattern string, overrides []string, cacher *buildCacher) (map[string]map[string]*benchmarkResult, error) {
+// against all clients matching clientPattern. Every result is passed to onResult
+// as soon as its benchmark finished.
+func benchmarkClients(daemon *dockerClient, clientPattern, benchmarkerPattern string, overrides []string, cacher *buildCacher, onResult resultHook) (map[string]map[string]*benchmarkResult, error) {
 
 	// Build all the clients matching the benchmark pattern
 	log15.Info("building clients for benchmark", "pattern", clientPattern)
@@ -50,6 +61,14 @@ func benchmarkClients(daemon *docker.Client, clientPattern, benchmarkerPattern s
 	if err != nil {
 		return nil, err
 	}
+	// Run every benchmark once, or once per resource limit point if sweeping
+	points := []*resourceLimits{nil}
+	if len(benchSweep) > 0 {
+		points = points[:0]
+		for i := range benchSweep {
+			points = append(points, &benchSweep[i])
+		}
+	}
 	// Iterate over all client and benchmarker combos and cross-execute them
 	results := make(map[string]map[string]*benchmarkResult)
 
@@ -61,37 +80,123 @@ func benchmarkClients(daemon *docker.Client, clientPattern, benchmarkerPattern s
 		}
 
 		for client, clientImage := range clients {
-
-			logger := log15.New("client", client, "benchmarker", benchmarker)
-
-			// Wrap the benchmark code into the Go's testing framework
-			var result *benchmarkResult
-			report := testing.Benchmark(func(b *testing.B) {
-				if result = benchmark(daemon, clientImage, benchmarkerImage, overrides, logger, filepath.Join(logdir, strings.Replace(client, string(filepath.Separator), "_", -1)), b); !result.Success {
-					b.Fatalf("benchmark failed")
+			if !selected("benchmarker", benchmarker, client) {
+				continue
+			}
+			modes, err := clientSyncModes(client, log15.New("client", client, "benchmarker", benchmarker))
+			if err != nil {
+				return nil, err
+			}
+			for _, mode := range modes {
+				for _, limits := range points {
+					var (
+						name      = benchmarker
+						key       = syncModeKey(client, mode)
+						clientdir = filepath.Join(logdir, strings.Replace(client, string(filepath.Separator), "_", -1), mode)
+						logger    = log15.New("client", client, "benchmarker", benchmarker)
+					)
+					if mode != "" {
+						logger = logger.New("syncmode", mode)
+					}
+					if limits != nil {
+						name = benchmarker + "@" + limits.String()
+						clientdir = filepath.Join(clientdir, strings.Replace(limits.String(), ",", "_", -1))
+						logger = logger.New("resources", limits.String())
+					}
+					// Wrap the benchmark code into the Go's testing framework
+					var result *benchmarkResult
+					report := testing.Benchmark(func(b *testing.B) {
+						if result = benchmark(daemon, clientImage, benchmarkerImage, overrides, syncModeEnvs(mode), limits, logger, clientdir, b); !result.Success {
+							b.Fatalf("benchmark failed")
+						}
+					})
+					result.Iterations = report.N
+					result.NsPerOp = report.NsPerOp()
+					result.SyncMode = mode
+					result.TruncatedLogs = truncatedLogsIn(clientdir)
+
+					// If a baseline was requested, fail the benchmark on a regression
+					if benchBaselines != nil {
+						if result.Baseline = benchBaselines.compare(key, name, result, *benchThreshold); result.Baseline != nil {
+							switch result.Baseline.Status {
+							case "new":
+								logger.Info("benchmark missing from baseline", "ns/op", result.NsPerOp)
+							case "regression":
+								logger.Error("benchmark regressed", "ns/op", result.NsPerOp, "baseline", result.Baseline.NsPerOp, "delta", fmt.Sprintf("%+.1f%%", result.Baseline.Delta))
+								result.Success = false
+							default:
+								logger.Info("benchmark within baseline", "ns/op", result.NsPerOp, "baseline", result.Baseline.NsPerOp, "delta", fmt.Sprintf("%+.1f%%", result.Baseline.Delta))
+							}
+						}
+					}
+					recordTest("benchmarker", result.Success, result.End.Sub(result.Start))
+					onResult("benchmarker", key, name, result.Success, result.End.Sub(result.Start), result)
+
+					if _, in := results[key]; !in {
+						results[key] = make(map[string]*benchmarkResult)
+					}
+					results[key][name] = result
 				}
-			})
-			result.Iterations = report.N
-			result.NsPerOp = report.NsPerOp()
-			if _, in := results[client]; !in {
-				results[client] = make(map[string]*benchmarkResult)
 			}
-			results[client][benchmarker] = result
 		}
 	}
 	return results, nil
 }
 
-func benchmark(daemon *docker.Client, client, benchmarker string, overrides []string, logger log15.Logger, logdir string, b *testing.B) *benchmarkResult {
+// influxEscaper escapes the characters that are special in InfluxDB line protocol
+// tag keys and values.
+var influxEscaper = strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ")
+
+// writeInfluxBenchmarks exports a set of benchmark results into a file in InfluxDB
+// line protocol, one point per client and benchmarker, all timestamped with the
+// end of the run.
+func writeInfluxBenchmarks(path string, results map[string]map[string]*benchmarkResult, end time.Time) error {
+	// Sort the clients and benchmarks to produce a stable output
+	clients := make([]string, 0, len(results))
+	for client := range results {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+
+	out := new(bytes.Buffer)
+	for _, client := range clients {
+		benchmarks := make([]string, 0, len(results[client]))
+		for benchmark := range results[client] {
+			benchmarks = append(benchmarks, benchmark)
+		}
+		sort.Strings(benchmarks)
+
+		for _, benchmark := range benchmarks {
+			result := results[client][benchmark]
+			fmt.Fprintf(out, "hive_benchmark,client=%s,benchmark=%s success=%t,iterations=%di,ns_per_op=%di,duration_ns=%di %d\n",
+				influxEscaper.Replace(client), influxEscaper.Replace(benchmark),
+				result.Success, result.Iterations, result.NsPerOp, int64(result.End.Sub(result.Start)), end.UnixNano())
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, out.Bytes(), 0644)
+}
+
+func benchmark(daemon *dockerClient, client, benchmarker string, overrides []string, envs map[string]string, limits *resourceLimits, logger log15.Logger, logdir string, b *testing.B) *benchmarkResult {
 	logger.Info("running client benchmark", "iterations", b.N)
 	result := &benchmarkResult{
-		Start: time.Now(),
+		Start:   time.Now(),
+		Ulimits: ulimits.String(),
+	}
+	// Benchmark resource sweep points take precedence over the client limits
+	if limits == nil {
+		limits = clientLimits
+	}
+	if limits != nil {
+		result.Resources = limits.String()
 	}
 	defer func() { result.End = time.Now() }()
 
 	// Create the client container and make sure it's cleaned up afterwards
 	logger.Debug("creating client container")
-	cc, err := createClientContainer(daemon, client, benchmarker, nil, overrides, nil)
+	cc, err := createClientContainer(daemon, client, benchmarker, nil, overrides, envs, "")
 	if err != nil {
 		logger.Error("failed to create client", "error", err)
 		result.Error = err
@@ -108,7 +213,7 @@ func benchmark(daemon *docker.Client, client, benchmarker string, overrides []st
 
 	// Start the client container and retrieve its IP address for the benchmarker
 	clogger.Debug("running client container")
-	cwaiter, err := runContainer(daemon, cc.ID, clogger, filepath.Join(logdir, "client.log"), false)
+	cwaiter, err := runContainer(daemon, cc.ID, clogger, filepath.Join(logdir, "client.log"), false, limits)
 	if err != nil {
 		clogger.Error("failed to run client", "error", err)
 		result.Error = err
@@ -135,8 +240,11 @@ func benchmark(daemon *docker.Client, client, benchmarker string, overrides []st
 			return result
 		}
 		if !c.State.Running {
-			clogger.Error("client container terminated")
+			clogger.Error("client container terminated", "oomkilled", c.State.OOMKilled)
 			result.Error = errors.New("terminated unexpectedly")
+			if c.State.OOMKilled {
+				result.Error = errClientOOMKilled
+			}
 			return result
 		}
 		// Container seems to be alive, check whether the RPC is accepting connections
@@ -161,11 +269,11 @@ func benchmark(daemon *docker.Client, client, benchmarker string, overrides []st
 	vc, err := daemon.CreateContainer(docker.CreateContainerOptions{
 		Config: &docker.Config{
 			Image: benchmarker,
-			Env: []string{
+			Env: append([]string{
 				"HIVE_CLIENT_IP=" + cip,
 				"HIVE_BENCHMARKER=http://" + bench.listener.Addr().String(),
 				"HIVE_BENCHMARKER_ITERS=" + strconv.Itoa(b.N),
-			},
+			}, globalSetupEnvs()...),
 		},
 	})
 	if err != nil {
@@ -186,7 +294,7 @@ func benchmark(daemon *docker.Client, client, benchmarker string, overrides []st
 	blogger.Debug("running benchmarker container")
 
 	b.ResetTimer()
-	bwaiter, err := runContainer(daemon, vc.ID, blogger, filepath.Join(logdir, "benchmarker.log"), false)
+	bwaiter, err := runContainer(daemon, vc.ID, blogger, filepath.Join(logdir, "benchmarker.log"), false, nil)
 	if err != nil {
 		blogger.Error("failed to run benchmarker", "error", err)
 		result.Error = err
@@ -203,6 +311,13 @@ func benchmark(daemon *docker.Client, client, benchmarker string, overrides []st
 		return result
 	}
 	result.Success = v.State.ExitCode == 0
+
+	// If the client was killed for exceeding its memory limit, report that instead
+	if err := checkOOMKilled(daemon, cc.ID); err != nil {
+		clogger.Error("client container killed by the OOM killer")
+		result.Error = err
+		result.Success = false
+	}
 	return result
 }
 
@@ -0,0 +1,126 @@
+// This file contains the utility methods for cleaning up the docker containers
+// and images left behind by killed hive runs.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// runLabel is the docker label all containers and images created by hive are
+// tagged with, holding the identifier of the run that created them.
+const runLabel = "hive.run-id"
+
+// terminating is set once hive received a termination signal, after which no new
+// images are built and no new containers created.
+var terminating uint32
+
+// errTerminated is returned for docker operations refused after hive received a
+// termination signal.
+var errTerminated = errors.New("hive terminated")
+
+// terminated reports whether hive received a termination signal.
+func terminated() bool {
+	return atomic.LoadUint32(&terminating) == 1
+}
+
+// handleTermination installs a signal handler that, upon SIGINT or SIGTERM, stops
+// and removes all the containers of the current run. Any test waiting on them will
+// fail, letting the run wind down through its regular shutdown path. A second
+// signal falls back to the default behaviour of killing hive outright.
+func handleTermination(daemon *dockerClient) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigc
+		signal.Stop(sigc)
+
+		log15.Error("hive terminated, cleaning up", "signal", sig)
+		atomic.StoreUint32(&terminating, 1)
+		cleanupRun(daemon)
+	}()
+}
+
+// cleanupRun removes all the containers created by the current run.
+func cleanupRun(daemon *dockerClient) {
+	removeRunContainers(daemon, func(container docker.APIContainers) bool {
+		return container.Labels[runLabel] == runPath
+	})
+}
+
+// cleanupStale removes the hive containers of previous runs, along with all the
+// dangling images hive built (e.g. superseded client versions). Containers still
+// running are left alone unless older than the grace period, as they might belong
+// to a concurrent hive run.
+func cleanupStale(daemon *dockerClient) {
+	now := time.Now()
+	removeRunContainers(daemon, func(container docker.APIContainers) bool {
+		return container.Labels[runLabel] != runPath && staleContainer(container, *cleanupGrace, now)
+	})
+	images, err := daemon.ListImages(docker.ListImagesOptions{Filters: map[string][]string{
+		"dangling": {"true"},
+		"label":    {runLabel},
+	}})
+	if err != nil {
+		log15.Error("failed to list dangling images", "error", err)
+		return
+	}
+	removed := 0
+	for _, image := range images {
+		if err := daemon.RemoveImage(image.ID); err != nil {
+			log15.Warn("failed to delete dangling image", "id", image.ID, "error", err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log15.Info("cleaned up dangling images", "count", removed)
+	}
+}
+
+// staleContainer reports whether a container of another hive run can be removed,
+// which is the case if it's not running anymore, or was created longer than the
+// grace period ago. Containers of unknown state are judged by their age alone.
+func staleContainer(container docker.APIContainers, grace time.Duration, now time.Time) bool {
+	switch container.State {
+	case "created", "exited", "dead":
+		return true
+	}
+	return now.Sub(time.Unix(container.Created, 0)) > grace
+}
+
+// removeRunContainers forcefully removes all the hive containers matching the given
+// filter.
+func removeRunContainers(daemon *dockerClient, match func(container docker.APIContainers) bool) {
+	containers, err := daemon.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Filters: map[string][]string{"label": {runLabel}},
+	})
+	if err != nil {
+		log15.Error("failed to list hive containers", "error", err)
+		return
+	}
+	removed := 0
+	for _, container := range containers {
+		if !match(container) {
+			continue
+		}
+		if err := daemon.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true}); err != nil {
+			log15.Error("failed to delete hive container", "id", container.ID[:8], "run", container.Labels[runLabel], "error", err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log15.Info("cleaned up hive containers", "count", removed)
+	}
+}
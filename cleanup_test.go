@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Tests that only stopped containers of other runs, or ones running for longer
+// than the grace period, are considered stale.
+func TestStaleContainer(t *testing.T) {
+	now := time.Now()
+	created := func(age time.Duration) int64 { return now.Add(-age).Unix() }
+
+	tests := []struct {
+		state string
+		age   time.Duration
+		stale bool
+	}{
+		{"exited", time.Minute, true},
+		{"created", time.Minute, true},
+		{"dead", time.Minute, true},
+		{"running", time.Minute, false},
+		{"paused", time.Minute, false},
+		{"restarting", time.Minute, false},
+		{"running", 2 * time.Hour, true},
+		{"", time.Minute, false}, // Old daemons don't report the state
+		{"", 2 * time.Hour, true},
+	}
+	for _, tt := range tests {
+		container := docker.APIContainers{State: tt.state, Created: created(tt.age)}
+		if stale := staleContainer(container, time.Hour, now); stale != tt.stale {
+			t.Errorf("%q aged %v: staleness mismatch: have %v, want %v", tt.state, tt.age, stale, tt.stale)
+		}
+	}
+}
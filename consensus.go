@@ -0,0 +1,165 @@
+// This file contains the utility methods for cross checking the chains imported
+// by different clients, detecting consensus divergences between them.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// chainBlock is the consensus relevant identity of a single imported block.
+type chainBlock struct {
+	Hash      string `json:"hash"`
+	StateRoot string `json:"stateRoot"`
+}
+
+// consensusDivergence describes the first block where a client's chain differs
+// from the one imported by the majority of the cross checked clients.
+type consensusDivergence struct {
+	Block    uint64 `json:"block"`              // Number of the first diverging block
+	Field    string `json:"field"`              // Block field that differs (hash, stateRoot or missing)
+	Expected string `json:"expected,omitempty"` // Field value of the majority of clients
+	Actual   string `json:"actual,omitempty"`   // Field value reported by this client
+}
+
+// rpcClient is the HTTP client used to query client RPC endpoints.
+var rpcClient = &http.Client{Timeout: 10 * time.Second}
+
+// callRPC issues a single JSON-RPC request against a client's HTTP endpoint.
+func callRPC(ip string, method string, params ...interface{}) (json.RawMessage, error) {
+	if params == nil {
+		params = []interface{}{}
+	}
+	req, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+	if err != nil {
+		return nil, err
+	}
+	res, err := rpcClient.Post(fmt.Sprintf("http://%s:8545", ip), "application/json", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != nil {
+		return nil, errors.New(reply.Error.Message)
+	}
+	return reply.Result, nil
+}
+
+// fetchChain retrieves the hashes and state roots of all the blocks a client has
+// imported, from genesis up to its current head.
+func fetchChain(ip string) ([]chainBlock, error) {
+	blob, err := callRPC(ip, "eth_blockNumber")
+	if err != nil {
+		return nil, err
+	}
+	var hex string
+	if err := json.Unmarshal(blob, &hex); err != nil {
+		return nil, err
+	}
+	head, err := strconv.ParseUint(strings.TrimPrefix(hex, "0x"), 16, 64)
+	if err != nil {
+		return nil, err
+	}
+	chain := make([]chainBlock, 0, head+1)
+	for number := uint64(0); number <= head; number++ {
+		blob, err := callRPC(ip, "eth_getBlockByNumber", fmt.Sprintf("0x%x", number), false)
+		if err != nil {
+			return nil, err
+		}
+		var block chainBlock
+		if err := json.Unmarshal(blob, &block); err != nil {
+			return nil, fmt.Errorf("block %d: %v", number, err)
+		}
+		chain = append(chain, block)
+	}
+	return chain, nil
+}
+
+// crossCheckChains compares the chains imported by all the clients running the
+// same validator. At the first block where the clients disagree, the clients not
+// siding with the majority are failed and their divergence point recorded.
+func crossCheckChains(results map[string]map[string]*validationResult, validator string, logger log15.Logger) {
+	// Gather the clients that managed to report a chain
+	clients := make([]string, 0, len(results))
+	for client, tests := range results {
+		if result, ok := tests[validator]; ok && result.chain != nil {
+			clients = append(clients, client)
+		}
+	}
+	sort.Strings(clients)
+	if len(clients) < 2 {
+		return
+	}
+	// Find the first block where any of the clients disagree
+	var longest int
+	for _, client := range clients {
+		if n := len(results[client][validator].chain); n > longest {
+			longest = n
+		}
+	}
+	for number := 0; number < longest; number++ {
+		votes := make(map[chainBlock]int)
+		for _, client := range clients {
+			if chain := results[client][validator].chain; number < len(chain) {
+				votes[chain[number]]++
+			}
+		}
+		// If every client has the same block at this height, move on
+		var agreed bool
+		for _, count := range votes {
+			agreed = len(votes) == 1 && count == len(clients)
+		}
+		if agreed {
+			continue
+		}
+		// Divergence found, pick the majority block and fail everyone else
+		var (
+			majority chainBlock
+			best     int
+		)
+		for block, count := range votes {
+			if count > best || (count == best && block.Hash < majority.Hash) {
+				majority, best = block, count
+			}
+		}
+		for _, client := range clients {
+			result := results[client][validator]
+
+			divergence := &consensusDivergence{Block: uint64(number)}
+			switch {
+			case number >= len(result.chain):
+				divergence.Field, divergence.Expected = "missing", majority.Hash
+			case result.chain[number].Hash != majority.Hash:
+				divergence.Field, divergence.Expected, divergence.Actual = "hash", majority.Hash, result.chain[number].Hash
+			case result.chain[number].StateRoot != majority.StateRoot:
+				divergence.Field, divergence.Expected, divergence.Actual = "stateRoot", majority.StateRoot, result.chain[number].StateRoot
+			default:
+				continue
+			}
+			logger.Error("client chain diverged", "client", client, "block", number, "field", divergence.Field)
+			result.Divergence = divergence
+			result.Success = false
+		}
+		return
+	}
+}
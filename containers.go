@@ -6,13 +6,16 @@ import (
 	"archive/tar"
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"github.com/fsouza/go-dockerclient"
 	"gopkg.in/inconshreveable/log15.v2"
@@ -25,8 +28,79 @@ const hiveEnvvarPrefix = "HIVE_"
 // hiveLogsFolder is the directory in which to place runtime logs from each of
 // the docker containers.
 
-// createShellContainer creates a docker container from the hive shell's image.
-func createShellContainer(daemon *docker.Client, image string, overrides []string) (*docker.Container, error) {
+// shellWorkdir is the folder the inner hive runs from within the shell container,
+// against which it resolves any relative paths given on the command line.
+const shellWorkdir = "/gopath/src/github.com/ethereum/hive"
+
+// shellPath maps a path given on the command line to the one the inner hive will
+// resolve it to within the shell container.
+func shellPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(shellWorkdir, path)
+}
+
+// bindShellOutput surfaces an output file requested on the command line from the
+// shell container, creating it on the host so the inner hive writes into it in
+// place. The file itself is mounted, not its folder, as the latter might shadow
+// the shell's own hive sources for files relative to the working directory.
+func bindShellOutput(binds []string, file string) ([]string, error) {
+	if file == "" || file == "-" {
+		return binds, nil
+	}
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	out.Close()
+
+	return append(binds, fmt.Sprintf("%s:%s", path, shellPath(file))), nil
+}
+
+// bindShellFolder surfaces an output folder requested on the command line from the
+// shell container, creating it on the host beforehand.
+func bindShellFolder(binds []string, dir string) ([]string, error) {
+	if dir == "" {
+		return binds, nil
+	}
+	path, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return append(binds, fmt.Sprintf("%s:%s", path, shellPath(dir))), nil
+}
+
+// bindShellInput makes an input file requested on the command line available read
+// only within the shell container, at the path the inner hive resolves it to. The
+// file must exist, otherwise docker would create an empty folder in its place.
+func bindShellInput(binds []string, file string) ([]string, error) {
+	if file == "" {
+		return binds, nil
+	}
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return append(binds, fmt.Sprintf("%s:%s:ro", path, shellPath(file))), nil
+}
+
+// createShellContainer creates a docker container from the hive shell's image, with
+// the inner hive handing its run summary over in the given file.
+func createShellContainer(daemon *dockerClient, image string, overrides []string, summary string) (*docker.Container, error) {
 	// Configure any workspace requirements for the container
 	pwd, err := os.Getwd()
 	if err != nil {
@@ -40,14 +114,25 @@ func createShellContainer(daemon *docker.Client, image string, overrides []strin
 	// Create the list of bind points to make host files available internally
 	binds := make([]string, 0, len(overrides)+2)
 	for _, override := range overrides {
-		file := override
-		if strings.Contains(override, ":") {
-			file = override[strings.LastIndex(override, ":")+1:]
-		}
-		if path, err := filepath.Abs(file); err == nil {
+		if path, err := filepath.Abs(parseFileOverride(override).file); err == nil {
 			binds = append(binds, fmt.Sprintf("%s:%s:ro", path, path)) // Mount to the same place, read only
 		}
 	}
+	for _, file := range []string{*genesisFile, *planFile, *benchBaseline} {
+		if binds, err = bindShellInput(binds, file); err != nil {
+			return nil, err
+		}
+	}
+	for _, file := range []string{*resultsFile, *junitFile, *streamFile, *influxFile, *coverageFile, *exportPlan, summary} {
+		if binds, err = bindShellOutput(binds, file); err != nil {
+			return nil, err
+		}
+	}
+	for _, dir := range []string{*dagCache, *logDir} {
+		if binds, err = bindShellFolder(binds, dir); err != nil {
+			return nil, err
+		}
+	}
 	binds = append(binds, []string{
 		fmt.Sprintf("%s/workspace/docker:/var/lib/docker", pwd),                                       // Surface any docker-in-docker data caches
 		fmt.Sprintf("%s/workspace/ethash:/gopath/src/github.com/ethereum/hive/workspace/ethash", pwd), // Surface any generated DAGs from the shell
@@ -64,7 +149,7 @@ func createShellContainer(daemon *docker.Client, image string, overrides []strin
 		Config: &docker.Config{
 			Image: image,
 			Env:   []string{fmt.Sprintf("UID=%d", uid)}, // Forward the user ID for the workspace permissions
-			Cmd:   os.Args[1:],
+			Cmd:   append([]string{"--shell-summary=" + summary}, os.Args[1:]...),
 		},
 		HostConfig: &docker.HostConfig{
 			Privileged: true, // Docker in docker requires privileged mode
@@ -73,14 +158,14 @@ func createShellContainer(daemon *docker.Client, image string, overrides []strin
 	})
 }
 
-// createEthashContainer creates a docker container to generate ethash DAGs.
-func createEthashContainer(daemon *docker.Client, image string) (*docker.Container, error) {
+// createEthashContainer creates a docker container to generate the ethash DAG of
+// the given epoch.
+func createEthashContainer(daemon *dockerClient, image string, epoch int) (*docker.Container, error) {
 	// Configure the workspace for ethash generation
-	pwd, err := os.Getwd()
+	ethash, err := ethashDir()
 	if err != nil {
 		return nil, err
 	}
-	ethash := filepath.Join(pwd, "workspace", "ethash")
 	if err := os.MkdirAll(ethash, os.ModePerm); err != nil {
 		return nil, err
 	}
@@ -94,7 +179,10 @@ func createEthashContainer(daemon *docker.Client, image string) (*docker.Contain
 	return daemon.CreateContainer(docker.CreateContainerOptions{
 		Config: &docker.Config{
 			Image: image,
-			Env:   []string{fmt.Sprintf("UID=%d", uid)}, // Forward the user ID for the workspace permissions
+			Env: []string{
+				fmt.Sprintf("UID=%d", uid),                         // Forward the user ID for the workspace permissions
+				fmt.Sprintf("BLOCK=%d", epoch*ethashEpochLength+1), // Any block within the epoch selects its DAG
+			},
 		},
 		HostConfig: &docker.HostConfig{
 			Binds: []string{fmt.Sprintf("%s:/root/.ethash", ethash)},
@@ -115,13 +203,15 @@ func createEthashContainer(daemon *docker.Client, image string) (*docker.Contain
 // the client binaries. This is useful in particular during client development as
 // local executables may be injected into a client docker container without them
 // needing to be rebuilt inside hive.
-func createClientContainer(daemon *docker.Client, client string, tester string, live *docker.Container, overrideFiles []string, overrideEnvs map[string]string) (*docker.Container, error) {
+//
+// Lastly, a genesis file may be specified to initialize the client's chain with,
+// taking precedence over both the tester's and the live container's genesis.
+func createClientContainer(daemon *dockerClient, client string, tester string, live *docker.Container, overrideFiles []string, overrideEnvs map[string]string, genesis string) (*docker.Container, error) {
 	// Configure the client for ethash consumption
-	pwd, err := os.Getwd()
+	ethash, err := ethashDir()
 	if err != nil {
 		return nil, err
 	}
-	ethash := filepath.Join(pwd, "workspace", "ethash")
 
 	// Gather all the hive environment variables from the tester
 	ti, err := daemon.InspectImage(tester)
@@ -140,8 +230,11 @@ func createClientContainer(daemon *docker.Client, client string, tester string,
 			vars = append(vars, key+"="+val)
 		}
 	}
-	// Create the client container with tester envvars injected
-	c, err := daemon.CreateContainer(docker.CreateContainerOptions{
+	// Create the client container with tester envvars injected, retrying transient
+	// failures as for image builds
+	logger := log15.New("client", client)
+
+	c, err := createContainerRetrying(daemon, docker.CreateContainerOptions{
 		Config: &docker.Config{
 			Image: client,
 			Env:   vars,
@@ -149,12 +242,12 @@ func createClientContainer(daemon *docker.Client, client string, tester string,
 		HostConfig: &docker.HostConfig{
 			Binds: []string{fmt.Sprintf("%s:/root/.ethash", ethash)},
 		},
-	})
+	}, logger)
 	if err != nil {
 		return nil, err
 	}
 	// Inject all the chain configuration files from the tester (or live container) into the client
-	t, err := daemon.CreateContainer(docker.CreateContainerOptions{Config: &docker.Config{Image: tester}})
+	t, err := createContainerRetrying(daemon, docker.CreateContainerOptions{Config: &docker.Config{Image: tester}}, logger)
 	if err != nil {
 		return nil, err
 	}
@@ -164,7 +257,9 @@ func createClientContainer(daemon *docker.Client, client string, tester string,
 		}
 	}()
 
-	if path := overrideEnvs["HIVE_INIT_GENESIS"]; path != "" {
+	if genesis != "" {
+		err = uploadToContainerAs(daemon, c.ID, []string{genesis}, []string{"genesis.json"})
+	} else if path := overrideEnvs["HIVE_INIT_GENESIS"]; path != "" {
 		err = copyBetweenContainers(daemon, c.ID, live.ID, path, "/genesis.json", false)
 	} else {
 		err = copyBetweenContainers(daemon, c.ID, t.ID, "", "/genesis.json", false)
@@ -199,18 +294,12 @@ func createClientContainer(daemon *docker.Client, client string, tester string,
 	// Inject any explicit file overrides into the client container
 	overrides := make([]string, 0, len(overrideFiles))
 	for _, override := range overrideFiles {
-		// Split the override into a pattern/path combo
-		pattern, file := ".", override
-		if strings.Contains(override, ":") {
-			pattern = override[:strings.LastIndex(override, ":")]
-			file = override[strings.LastIndex(override, ":")+1:]
-		}
 		// If the pattern matches the client image, override the file
-		re, err := regexp.Compile(pattern)
+		ok, file, err := parseFileOverride(override).match(client)
 		if err != nil {
 			return nil, err
 		}
-		if re.MatchString(client) {
+		if ok {
 			overrides = append(overrides, file)
 		}
 	}
@@ -223,8 +312,183 @@ func createClientContainer(daemon *docker.Client, client string, tester string,
 	return c, nil
 }
 
+// createLabel is the docker label every retried container creation attempt is
+// tagged with, holding an identifier unique to the attempt.
+const createLabel = "hive.create-id"
+
+// createAttempts counts the container creation attempts, to identify them.
+var createAttempts uint64
+
+// createContainerRetrying creates a container, retrying transient failures as for
+// image builds. A request failing with a network error may still have created the
+// container, so every attempt is labelled uniquely and any container a failed one
+// left behind is removed, instead of leaking a duplicate until the run ends.
+func createContainerRetrying(daemon *dockerClient, opts docker.CreateContainerOptions, logger log15.Logger) (*docker.Container, error) {
+	var c *docker.Container
+	err := retryBuild(logger, func() (err error) {
+		id := fmt.Sprintf("%s-%d", runPath, atomic.AddUint64(&createAttempts, 1))
+
+		config := *opts.Config
+		config.Labels = map[string]string{createLabel: id}
+		for key, value := range opts.Config.Labels {
+			config.Labels[key] = value
+		}
+		attempt := opts
+		attempt.Config = &config
+
+		if c, err = daemon.CreateContainer(attempt); err != nil {
+			removeCreated(daemon, id, logger)
+		}
+		return err
+	})
+	return c, err
+}
+
+// removeCreated removes any container created by a failed creation attempt.
+func removeCreated(daemon *dockerClient, id string, logger log15.Logger) {
+	containers, err := daemon.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Filters: map[string][]string{"label": {createLabel + "=" + id}},
+	})
+	if err != nil {
+		logger.Error("failed to look up containers of failed creation", "error", err)
+		return
+	}
+	for _, c := range containers {
+		logger.Warn("removing container of failed creation", "id", c.ID[:8])
+		if err := daemon.RemoveContainer(docker.RemoveContainerOptions{ID: c.ID, Force: true}); err != nil {
+			logger.Error("failed to remove container of failed creation", "id", c.ID[:8], "error", err)
+		}
+	}
+}
+
+// fileOverride is a single regexp:file pair from the override flag, selecting a
+// local file to inject into all the client images matching the pattern.
+type fileOverride struct {
+	pattern string // Regexp selecting the client images to inject into
+	file    string // Local file to inject into the container root
+}
+
+// parseFileOverride splits an override flag entry into its pattern and file
+// components. Entries without an explicit pattern apply to all clients.
+func parseFileOverride(override string) fileOverride {
+	if idx := strings.LastIndex(override, ":"); idx >= 0 {
+		return fileOverride{pattern: override[:idx], file: override[idx+1:]}
+	}
+	return fileOverride{pattern: ".", file: override}
+}
+
+// match checks whether the override applies to the given client image, returning
+// the local file to inject if so.
+func (o fileOverride) match(client string) (bool, string, error) {
+	re, err := regexp.Compile(o.pattern)
+	if err != nil {
+		return false, "", err
+	}
+	return re.MatchString(client), o.file, nil
+}
+
+// target returns the path within the container the override will be placed to.
+func (o fileOverride) target() string {
+	return "/" + filepath.Base(o.file)
+}
+
+// checkOverrideFiles ensures that the local source file of every override exists,
+// failing fast on typos before any images are built or containers started.
+func checkOverrideFiles(overrides []string) error {
+	for _, override := range overrides {
+		file := parseFileOverride(override).file
+		if _, err := os.Stat(file); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("override file %s not found", file)
+			}
+			return fmt.Errorf("override file %s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+// verifyOverrides checks that all the file overrides apply cleanly to the client
+// images they match: the local source files must be readable and the folders of
+// the override destinations must exist within the images. Destinations missing
+// from an image are only warned about, as overrides may add new files too. All
+// problems are reported, not just the first one encountered.
+func verifyOverrides(daemon *dockerClient, clients map[string]string, overrides []string) error {
+	var failures int
+	for _, override := range overrides {
+		o := parseFileOverride(override)
+		logger := log15.New("override", override)
+
+		// Make sure the local file exists and can be read
+		if file, err := os.Open(o.file); err != nil {
+			logger.Error("override source unreadable", "file", o.file, "error", err)
+			failures++
+		} else {
+			info, err := file.Stat()
+			file.Close()
+			if err == nil && info.IsDir() {
+				err = errors.New("is a directory")
+			}
+			if err != nil {
+				logger.Error("override source unusable", "file", o.file, "error", err)
+				failures++
+			}
+		}
+		// Make sure the destination is valid in every matching client. The root folder
+		// surely exists, no need to download the whole image to check it.
+		for client, image := range clients {
+			ok, _, err := o.match(client)
+			if err != nil {
+				logger.Error("invalid override pattern", "pattern", o.pattern, "error", err)
+				failures++
+				break
+			}
+			if !ok {
+				continue
+			}
+			if dir := filepath.Dir(o.target()); dir != "/" {
+				exists, err := existsInImage(daemon, image, dir, logger)
+				if err != nil {
+					logger.Error("failed to check override destination folder", "client", client, "folder", dir, "error", err)
+					failures++
+					continue
+				}
+				if !exists {
+					logger.Error("override destination folder missing from image", "client", client, "folder", dir)
+					failures++
+					continue
+				}
+			}
+			exists, err := existsInImage(daemon, image, o.target(), logger)
+			if err != nil {
+				logger.Error("failed to check override destination", "client", client, "target", o.target(), "error", err)
+				failures++
+				continue
+			}
+			if !exists {
+				logger.Warn("override destination missing from image, adding new file", "client", client, "target", o.target())
+			}
+			logger.Debug("override verified", "client", client, "target", o.target())
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d override problem(s) found", failures)
+	}
+	return nil
+}
+
 // uploadToContainer injects a batch of files into the target container.
-func uploadToContainer(daemon *docker.Client, id string, files []string) error {
+func uploadToContainer(daemon *dockerClient, id string, files []string) error {
+	names := make([]string, len(files))
+	for i, path := range files {
+		names[i] = filepath.Base(path)
+	}
+	return uploadToContainerAs(daemon, id, files, names)
+}
+
+// uploadToContainerAs injects a batch of files into the root of the target
+// container, naming each of them by the corresponding entry of names.
+func uploadToContainerAs(daemon *dockerClient, id string, files []string, names []string) error {
 	// Short circuit if there are no files to upload
 	if len(files) == 0 {
 		return nil
@@ -233,7 +497,7 @@ func uploadToContainer(daemon *docker.Client, id string, files []string) error {
 	tarball := new(bytes.Buffer)
 	tw := tar.NewWriter(tarball)
 
-	for _, path := range files {
+	for i, path := range files {
 		// Fetch the next file to inject into the container
 		file, err := os.Open(path)
 		if err != nil {
@@ -251,7 +515,7 @@ func uploadToContainer(daemon *docker.Client, id string, files []string) error {
 		}
 		// Insert the file into the tarball archive
 		header := &tar.Header{
-			Name: filepath.Base(file.Name()),
+			Name: names[i],
 			Mode: int64(info.Mode()),
 			Size: int64(len(data)),
 		}
@@ -273,7 +537,7 @@ func uploadToContainer(daemon *docker.Client, id string, files []string) error {
 }
 
 // copyBetweenContainers copies a file from one docker container to another one.
-func copyBetweenContainers(daemon *docker.Client, dest, src string, path, target string, optional bool) error {
+func copyBetweenContainers(daemon *dockerClient, dest, src string, path, target string, optional bool) error {
 	// If no path was specified, use the target as the default
 	if path == "" {
 		path = target
@@ -323,8 +587,9 @@ func copyBetweenContainers(daemon *docker.Client, dest, src string, path, target
 
 // runContainer attaches to the output streams of an existing container, then
 // starts executing the container and returns the CloseWaiter to allow the caller
-// to wait for termination.
-func runContainer(daemon *docker.Client, id string, logger log15.Logger, logfile string, shell bool) (docker.CloseWaiter, error) {
+// to wait for termination. Optionally the container's memory and CPU usage can be
+// constrained to the given limits.
+func runContainer(daemon *dockerClient, id string, logger log15.Logger, logfile string, shell bool, limits *resourceLimits) (docker.CloseWaiter, error) {
 	// If we're the outer shell, log straight to stderr, nothing fancy
 	stdout := io.Writer(os.Stdout)
 	stream := io.Writer(os.Stderr)
@@ -334,10 +599,15 @@ func runContainer(daemon *docker.Client, id string, logger log15.Logger, logfile
 		if err := os.MkdirAll(filepath.Dir(logfile), os.ModePerm); err != nil {
 			return nil, err
 		}
-		log, err := os.OpenFile(logfile, os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_TRUNC, os.ModePerm)
+		file, err := os.OpenFile(logfile, os.O_RDWR|os.O_CREATE|os.O_SYNC|os.O_TRUNC, os.ModePerm)
 		if err != nil {
 			return nil, err
 		}
+		// If requested, cap the log size, retaining only the most recent output
+		log := io.WriteCloser(file)
+		if *logMaxBytes > 0 {
+			log = newCappedLog(file, logfile, *logMaxBytes)
+		}
 		stream = io.Writer(log)
 		fdsToClose = append(fdsToClose, log)
 
@@ -381,6 +651,12 @@ func runContainer(daemon *docker.Client, id string, logger log15.Logger, logfile
 	logger.Debug("starting container")
 
 	hostConfig := &docker.HostConfig{Privileged: true, CapAdd: []string{"SYS_PTRACE"}, SecurityOpt: []string{"seccomp=unconfined"}}
+	if !shell {
+		hostConfig.Ulimits = ulimits
+	}
+	if limits != nil {
+		limits.apply(hostConfig)
+	}
 	if err := daemon.StartContainer(id, hostConfig); err != nil {
 		logger.Error("failed to start container", "error", err)
 		return nil, err
@@ -392,6 +668,55 @@ func runContainer(daemon *docker.Client, id string, logger log15.Logger, logfile
 	}, nil
 }
 
+// ulimitNames is the set of resource limits docker accepts for containers.
+var ulimitNames = map[string]bool{
+	"core": true, "cpu": true, "data": true, "fsize": true, "locks": true,
+	"memlock": true, "msgqueue": true, "nice": true, "nofile": true, "nproc": true,
+	"rss": true, "rtprio": true, "rttime": true, "sigpending": true, "stack": true,
+}
+
+// ulimitList is a repeatable command line flag collecting the resource limits to
+// apply to all started containers, each in the form of NAME=SOFT:HARD.
+type ulimitList []docker.ULimit
+
+// String implements flag.Value, formatting the limits back into flag form.
+func (l *ulimitList) String() string {
+	limits := make([]string, 0, len(*l))
+	for _, limit := range *l {
+		limits = append(limits, fmt.Sprintf("%s=%d:%d", limit.Name, limit.Soft, limit.Hard))
+	}
+	return strings.Join(limits, ",")
+}
+
+// Set implements flag.Value, parsing and validating a single NAME=SOFT:HARD limit.
+func (l *ulimitList) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid ulimit %q, want NAME=SOFT:HARD", value)
+	}
+	name := parts[0]
+	if !ulimitNames[name] {
+		return fmt.Errorf("unknown ulimit %q", name)
+	}
+	limits := strings.SplitN(parts[1], ":", 2)
+	if len(limits) != 2 {
+		return fmt.Errorf("invalid ulimit %q, want NAME=SOFT:HARD", value)
+	}
+	soft, err := strconv.ParseInt(limits[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid soft ulimit %q: %v", limits[0], err)
+	}
+	hard, err := strconv.ParseInt(limits[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid hard ulimit %q: %v", limits[1], err)
+	}
+	if soft > hard {
+		return fmt.Errorf("soft ulimit %d above hard ulimit %d for %s", soft, hard, name)
+	}
+	*l = append(*l, docker.ULimit{Name: name, Soft: soft, Hard: hard})
+	return nil
+}
+
 // fdClosingWaiter wraps a docker.CloseWaiter and closes all io.Closer
 // instances passed to it, after it is done waiting.
 type fdClosingWaiter struct {
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Tests that ulimit flags are parsed into docker limits and invalid ones rejected.
+func TestUlimitListSet(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []docker.ULimit
+		fail  bool
+	}{
+		{"nofile=1024:4096", []docker.ULimit{{Name: "nofile", Soft: 1024, Hard: 4096}}, false},
+		{"core=0:0", []docker.ULimit{{Name: "core", Soft: 0, Hard: 0}}, false},
+		{"nproc=-1:-1", []docker.ULimit{{Name: "nproc", Soft: -1, Hard: -1}}, false},
+		{"nofile=4096:1024", nil, true},
+		{"nofile=1024", nil, true},
+		{"nofile", nil, true},
+		{"files=1:2", nil, true},
+		{"nofile=a:2", nil, true},
+		{"nofile=1:b", nil, true},
+	}
+	for _, tt := range tests {
+		var limits ulimitList
+		err := limits.Set(tt.value)
+		if (err != nil) != tt.fail {
+			t.Errorf("%q: failure mismatch: have %v, want failure %v", tt.value, err, tt.fail)
+			continue
+		}
+		if !reflect.DeepEqual([]docker.ULimit(limits), tt.want) {
+			t.Errorf("%q: limits mismatch: have %v, want %v", tt.value, limits, tt.want)
+		}
+	}
+	// Repeated flags accumulate and format back into flag form
+	var limits ulimitList
+	for _, value := range []string{"nofile=1024:4096", "core=0:0"} {
+		if err := limits.Set(value); err != nil {
+			t.Fatalf("%q: failed to set: %v", value, err)
+		}
+	}
+	if have, want := limits.String(), "nofile=1024:4096,core=0:0"; have != want {
+		t.Errorf("formatted limits mismatch: have %q, want %q", have, want)
+	}
+}
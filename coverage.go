@@ -0,0 +1,170 @@
+// This file contains the utility methods for reporting how much of the possible
+// client/test matrix a hive run actually exercised.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// coverageReport summarises the fraction of all the discoverable client and test
+// combinations that were actually run, listing the ones that were not.
+type coverageReport struct {
+	Possible   int                         `json:"possible"`       // Number of discoverable client/test combinations
+	Run        int                         `json:"run"`            // Number of combinations actually run
+	Coverage   float64                     `json:"coverage"`       // Fraction of the combinations run
+	Categories map[string]*coverageSummary `json:"categories"`     // Coverage broken down per test category
+	Gaps       []coverageGap               `json:"gaps,omitempty"` // Combinations that were not run
+}
+
+// coverageSummary is the coverage of a single test category.
+type coverageSummary struct {
+	Possible int     `json:"possible"` // Number of discoverable client/test combinations
+	Run      int     `json:"run"`      // Number of combinations actually run
+	Coverage float64 `json:"coverage"` // Fraction of the combinations run
+}
+
+// coverageGap is a single client/test combination that was not run.
+type coverageGap struct {
+	Category string `json:"category"`
+	Client   string `json:"client"`
+	Test     string `json:"test"`
+	Reason   string `json:"reason"` // Why the combination was not run (if known)
+}
+
+// coverageCategory is the discovery configuration of a single test category.
+type coverageCategory struct {
+	name    string                     // Name of the category (validator, simulator, etc)
+	root    string                     // Folder containing the test image definitions
+	pattern string                     // Pattern the tests were selected by (empty = not run)
+	ran     map[string]map[string]bool // Client/test combinations actually run
+	skipped map[string]map[string]bool // Client/test combinations skipped via a skip pattern
+}
+
+// writeCoverageReport assembles a coverage report for a run and writes it to path.
+func writeCoverageReport(path string, results *resultSet, clientPattern string, testPatterns map[string]string) error {
+	// Discover all the clients and the ones selected by the run
+	allClients, err := listNestedImages("clients", ".")
+	if err != nil {
+		return err
+	}
+	selected, err := listNestedImages("clients", clientPattern)
+	if err != nil {
+		return err
+	}
+	selectedClients := make(map[string]bool)
+	for _, client := range selected {
+		selectedClients[client] = true
+	}
+	for client := range gitClients {
+		allClients = append(allClients, client)
+		selectedClients[client] = true
+	}
+	sort.Strings(allClients)
+
+	// Gather which client/test combinations were run in each category
+	categories := []*coverageCategory{
+		{name: "validator", root: "validators", pattern: testPatterns["validator"], ran: make(map[string]map[string]bool), skipped: make(map[string]map[string]bool)},
+		{name: "simulator", root: "simulators", pattern: testPatterns["simulator"], ran: make(map[string]map[string]bool), skipped: make(map[string]map[string]bool)},
+		{name: "benchmarker", root: "benchmarkers", pattern: testPatterns["benchmarker"], ran: make(map[string]map[string]bool), skipped: make(map[string]map[string]bool)},
+	}
+	mark := func(combos map[string]map[string]bool, client, test string) {
+		if combos[client] == nil {
+			combos[client] = make(map[string]bool)
+		}
+		combos[client][test] = true
+	}
+	for key, tests := range results.Validations {
+		for test, result := range tests {
+			client := strings.TrimSuffix(key, "/"+result.SyncMode)
+			if result.Skipped {
+				mark(categories[0].skipped, client, test)
+			} else {
+				mark(categories[0].ran, client, test)
+			}
+		}
+	}
+	for client, tests := range results.Simulations {
+		for test, result := range tests {
+			switch {
+			case result.Skipped:
+				mark(categories[1].skipped, client, test)
+			case !result.NotRun:
+				mark(categories[1].ran, client, test)
+			}
+		}
+	}
+	for key, tests := range results.Benchmarks {
+		for test, result := range tests {
+			client := strings.TrimSuffix(key, "/"+result.SyncMode)
+			if categories[2].ran[client] == nil {
+				categories[2].ran[client] = make(map[string]bool)
+			}
+			// Resource swept benchmarks are keyed as test@limits, count them once
+			categories[2].ran[client][strings.SplitN(test, "@", 2)[0]] = true
+		}
+	}
+	// Cross check every possible combination against the ones run
+	report := &coverageReport{Categories: make(map[string]*coverageSummary)}
+	for _, category := range categories {
+		allTests, err := listNestedImages(category.root, ".")
+		if err != nil {
+			return err
+		}
+		selectedTests := make(map[string]bool)
+		if category.pattern != "" {
+			tests, err := listNestedImages(category.root, category.pattern)
+			if err != nil {
+				return err
+			}
+			for _, test := range tests {
+				selectedTests[test] = true
+			}
+		}
+		summary := new(coverageSummary)
+		for _, test := range allTests {
+			for _, client := range allClients {
+				summary.Possible++
+				if category.ran[client][test] {
+					summary.Run++
+					continue
+				}
+				gap := coverageGap{Category: category.name, Client: client, Test: test}
+				switch {
+				case !selectedClients[client]:
+					gap.Reason = "client not selected"
+				case !selectedTests[test]:
+					gap.Reason = "test not selected"
+				case category.skipped[client][test]:
+					gap.Reason = "test skipped"
+				default:
+					gap.Reason = "not run"
+				}
+				report.Gaps = append(report.Gaps, gap)
+			}
+		}
+		if summary.Possible > 0 {
+			summary.Coverage = float64(summary.Run) / float64(summary.Possible)
+		}
+		report.Categories[category.name] = summary
+		report.Possible += summary.Possible
+		report.Run += summary.Run
+	}
+	if report.Possible > 0 {
+		report.Coverage = float64(report.Run) / float64(report.Possible)
+	}
+	// Serialize the report and write it out
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, out, 0644)
+}
@@ -0,0 +1,121 @@
+// This file contains the utility methods for caching the generated ethash DAG
+// across hive runs, avoiding its costly regeneration when still valid.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// dagManifestFile is the name of the file within the DAG cache describing the
+// generated DAG files. It is only written once generation finished, so a cache
+// without it (or with files not matching it) is regenerated.
+const dagManifestFile = "hive-dag.json"
+
+// dagManifest describes the contents of a DAG cache folder.
+type dagManifest struct {
+	Epochs []int                  `json:"epochs"` // Ethash epochs the DAG was generated for
+	Files  map[string]dagFileInfo `json:"files"`  // Generated files within the cache folder
+}
+
+// dagFileInfo is the expected size and checksum of a single generated DAG file.
+type dagFileInfo struct {
+	Size   int64  `json:"size"`   // Size of the file in bytes
+	SHA256 string `json:"sha256"` // Hex encoded SHA256 checksum of the file
+}
+
+// ethashDir returns the host folder holding the ethash DAG, which is the cache
+// requested via -dagcache or a folder within the run's workspace otherwise.
+func ethashDir() (string, error) {
+	if *dagCache != "" {
+		return filepath.Abs(*dagCache)
+	}
+	pwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(pwd, "workspace", "ethash"), nil
+}
+
+// validDAGCache checks whether a DAG cache folder contains a complete, intact DAG
+// for all the requested epochs, comparing all files against the manifest.
+func validDAGCache(dir string, epochs []int) (bool, error) {
+	blob, err := ioutil.ReadFile(filepath.Join(dir, dagManifestFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var manifest dagManifest
+	if err := json.Unmarshal(blob, &manifest); err != nil || len(manifest.Files) == 0 {
+		return false, nil
+	}
+	cached := make(map[int]bool)
+	for _, epoch := range manifest.Epochs {
+		cached[epoch] = true
+	}
+	for _, epoch := range epochs {
+		if !cached[epoch] {
+			return false, nil
+		}
+	}
+	for name, want := range manifest.Files {
+		have, err := dagFileChecksum(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if have != want {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// writeDAGManifest records the epochs and the size and checksum of all the files
+// within a freshly generated DAG cache folder.
+func writeDAGManifest(dir string, epochs []int) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	manifest := dagManifest{Epochs: epochs, Files: make(map[string]dagFileInfo)}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || info.Name() == dagManifestFile {
+			continue
+		}
+		if manifest.Files[info.Name()], err = dagFileChecksum(filepath.Join(dir, info.Name())); err != nil {
+			return err
+		}
+	}
+	out, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, dagManifestFile), out, 0644)
+}
+
+// dagFileChecksum measures the size and SHA256 checksum of a single file.
+func dagFileChecksum(path string) (dagFileInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return dagFileInfo{}, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return dagFileInfo{}, err
+	}
+	return dagFileInfo{Size: size, SHA256: hex.EncodeToString(hasher.Sum(nil))}, nil
+}
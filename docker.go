@@ -0,0 +1,278 @@
+// This file contains the wrapper around the docker API client, funnelling all the
+// daemon calls made by hive through a single choke point.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// maxDockerBackoff is the maximum time to wait between two reconnection attempts
+// to a temporarily unavailable docker daemon.
+const maxDockerBackoff = 5 * time.Second
+
+// dockerClient wraps a docker API client, gating every daemon call hive makes to
+// allow throttling and retrying them. All docker methods used by hive should be wrapped here,
+// otherwise they bypass the gating by hitting the embedded client directly.
+type dockerClient struct {
+	*docker.Client
+	limiter   *rateLimiter  // Optional rate limiter for the API calls (nil = unlimited)
+	reconnect time.Duration // Time window to retry transient daemon failures for (0 = no retries)
+}
+
+// newDockerClient wraps a docker API client, limiting the number of calls issued
+// per second to the given rate and retrying calls failing due to the daemon being
+// temporarily unreachable for up to the given reconnect window. A non-positive
+// rate means unlimited, a non-positive window disables retries.
+func newDockerClient(client *docker.Client, rate float64, reconnect time.Duration) *dockerClient {
+	d := &dockerClient{Client: client, reconnect: reconnect}
+	if rate > 0 {
+		d.limiter = newRateLimiter(rate)
+		dockerRateMetric.set(rate)
+	}
+	return d
+}
+
+// dialDocker creates a docker API client for the daemon requested via the flags.
+// If any of the TLS certificates were given, the connection is secured. Without
+// an explicit -docker-endpoint, the standard DOCKER_HOST, DOCKER_TLS_VERIFY and
+// DOCKER_CERT_PATH environment variables are respected, if set.
+func dialDocker() (*docker.Client, error) {
+	explicit := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "docker-endpoint" {
+			explicit = true
+		}
+	})
+	if *dockerTLSCert != "" || *dockerTLSKey != "" || *dockerTLSCA != "" {
+		endpoint := *dockerEndpoint
+		if host := os.Getenv("DOCKER_HOST"); !explicit && host != "" {
+			endpoint = host
+		}
+		return docker.NewTLSClient(endpoint, *dockerTLSCert, *dockerTLSKey, *dockerTLSCA)
+	}
+	if !explicit && os.Getenv("DOCKER_HOST") != "" {
+		return docker.NewClientFromEnv()
+	}
+	return docker.NewClient(*dockerEndpoint)
+}
+
+// call gates a single docker API call, blocking until it is allowed to proceed.
+// If the daemon cannot be reached, the call is retried with exponential backoff
+// until the reconnect window expires. Any other failure is returned as is.
+func (d *dockerClient) call(fn func() error) error {
+	var (
+		start = time.Now()
+		delay = newBackoff(250*time.Millisecond, maxDockerBackoff)
+	)
+	for attempt := 1; ; attempt++ {
+		if d.limiter != nil {
+			if delay := d.limiter.wait(); delay > 0 {
+				dockerThrottledMetric.add("", delay.Seconds())
+			}
+		}
+		err := fn()
+
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		dockerCallsMetric.inc(metricLabels("result", result))
+
+		if err == nil || d.reconnect <= 0 || !transientDockerError(err) {
+			return err
+		}
+		if time.Since(start)+delay.next() > d.reconnect {
+			log15.Error("docker daemon unreachable, giving up", "attempts", attempt, "error", err)
+			return err
+		}
+		log15.Warn("docker daemon unreachable, reconnecting", "attempt", attempt, "backoff", delay.next(), "error", err)
+		delay.wait()
+	}
+}
+
+// transientDockerError checks whether a docker API failure was caused by the daemon
+// being temporarily unreachable (e.g. restarting or overloaded) as opposed to the
+// daemon rejecting the request. Only failures where the request surely was not
+// processed are considered transient, since not all calls are safe to repeat.
+func transientDockerError(err error) bool {
+	if errors.Is(err, docker.ErrConnectionRefused) {
+		return true
+	}
+	var derr *docker.Error
+	if errors.As(err, &derr) {
+		return derr.Status == 503
+	}
+	var operr *net.OpError
+	return errors.As(err, &operr) && operr.Op == "dial"
+}
+
+// Version wraps docker.Client.Version.
+func (d *dockerClient) Version() (env *docker.Env, err error) {
+	err = d.call(func() error { env, err = d.Client.Version(); return err })
+	return env, err
+}
+
+// Info wraps docker.Client.Info.
+func (d *dockerClient) Info() (info *docker.DockerInfo, err error) {
+	err = d.call(func() error { info, err = d.Client.Info(); return err })
+	return info, err
+}
+
+// BuildImage wraps docker.Client.BuildImage, labelling the image with the run that
+// built it.
+func (d *dockerClient) BuildImage(opts docker.BuildImageOptions) error {
+	if terminated() {
+		return errTerminated
+	}
+	labels := map[string]string{runLabel: runPath}
+	for key, value := range opts.Labels {
+		labels[key] = value
+	}
+	opts.Labels = labels
+	return d.call(func() error { return d.Client.BuildImage(opts) })
+}
+
+// InspectImage wraps docker.Client.InspectImage.
+func (d *dockerClient) InspectImage(name string) (image *docker.Image, err error) {
+	err = d.call(func() error { image, err = d.Client.InspectImage(name); return err })
+	return image, err
+}
+
+// ListImages wraps docker.Client.ListImages.
+func (d *dockerClient) ListImages(opts docker.ListImagesOptions) (images []docker.APIImages, err error) {
+	err = d.call(func() error { images, err = d.Client.ListImages(opts); return err })
+	return images, err
+}
+
+// RemoveImage wraps docker.Client.RemoveImage.
+func (d *dockerClient) RemoveImage(name string) error {
+	return d.call(func() error { return d.Client.RemoveImage(name) })
+}
+
+// CreateContainer wraps docker.Client.CreateContainer, labelling the container
+// with the current run's identifier to allow cleaning it up if hive is killed.
+// Once hive is terminating, no new containers are created and any created while
+// the run's containers were being swept is removed right away.
+func (d *dockerClient) CreateContainer(opts docker.CreateContainerOptions) (container *docker.Container, err error) {
+	if terminated() {
+		return nil, errTerminated
+	}
+	if opts.Config != nil {
+		config := *opts.Config
+		config.Labels = map[string]string{runLabel: runPath}
+		for key, value := range opts.Config.Labels {
+			config.Labels[key] = value
+		}
+		opts.Config = &config
+	}
+	err = d.call(func() error { container, err = d.Client.CreateContainer(opts); return err })
+	if err == nil && terminated() {
+		d.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true})
+		return nil, errTerminated
+	}
+	return container, err
+}
+
+// ListContainers wraps docker.Client.ListContainers.
+func (d *dockerClient) ListContainers(opts docker.ListContainersOptions) (containers []docker.APIContainers, err error) {
+	err = d.call(func() error { containers, err = d.Client.ListContainers(opts); return err })
+	return containers, err
+}
+
+// InspectContainer wraps docker.Client.InspectContainer.
+func (d *dockerClient) InspectContainer(id string) (container *docker.Container, err error) {
+	err = d.call(func() error { container, err = d.Client.InspectContainer(id); return err })
+	return container, err
+}
+
+// StartContainer wraps docker.Client.StartContainer.
+func (d *dockerClient) StartContainer(id string, hostConfig *docker.HostConfig) error {
+	return d.call(func() error { return d.Client.StartContainer(id, hostConfig) })
+}
+
+// StopContainer wraps docker.Client.StopContainer.
+func (d *dockerClient) StopContainer(id string, timeout uint) error {
+	return d.call(func() error { return d.Client.StopContainer(id, timeout) })
+}
+
+// RemoveContainer wraps docker.Client.RemoveContainer.
+func (d *dockerClient) RemoveContainer(opts docker.RemoveContainerOptions) error {
+	return d.call(func() error { return d.Client.RemoveContainer(opts) })
+}
+
+// AttachToContainerNonBlocking wraps docker.Client.AttachToContainerNonBlocking.
+func (d *dockerClient) AttachToContainerNonBlocking(opts docker.AttachToContainerOptions) (waiter docker.CloseWaiter, err error) {
+	err = d.call(func() error { waiter, err = d.Client.AttachToContainerNonBlocking(opts); return err })
+	return waiter, err
+}
+
+// UploadToContainer wraps docker.Client.UploadToContainer.
+func (d *dockerClient) UploadToContainer(id string, opts docker.UploadToContainerOptions) error {
+	return d.call(func() error { return d.Client.UploadToContainer(id, opts) })
+}
+
+// DownloadFromContainer wraps docker.Client.DownloadFromContainer.
+func (d *dockerClient) DownloadFromContainer(id string, opts docker.DownloadFromContainerOptions) error {
+	return d.call(func() error { return d.Client.DownloadFromContainer(id, opts) })
+}
+
+// CreateExec wraps docker.Client.CreateExec.
+func (d *dockerClient) CreateExec(opts docker.CreateExecOptions) (exec *docker.Exec, err error) {
+	err = d.call(func() error { exec, err = d.Client.CreateExec(opts); return err })
+	return exec, err
+}
+
+// StartExec wraps docker.Client.StartExec.
+func (d *dockerClient) StartExec(id string, opts docker.StartExecOptions) error {
+	return d.call(func() error { return d.Client.StartExec(id, opts) })
+}
+
+// rateLimiter is a simple token bucket, refilling at a constant rate up to a
+// burst of one second's worth of tokens.
+type rateLimiter struct {
+	rate   float64   // Number of tokens refilled per second
+	burst  float64   // Maximum number of tokens the bucket may hold
+	tokens float64   // Number of tokens currently available (negative = reserved)
+	last   time.Time // Time instance of the last refill
+	lock   sync.Mutex
+}
+
+// newRateLimiter creates a full token bucket refilling at the given rate.
+func newRateLimiter(rate float64) *rateLimiter {
+	burst := math.Max(1, rate)
+	return &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// wait reserves a token from the bucket, blocking until it becomes available. The
+// time spent waiting is returned.
+func (l *rateLimiter) wait() time.Duration {
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+
+	time.Sleep(delay)
+	return delay
+}
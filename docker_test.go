@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that the rate limiter lets a full burst through without waiting, delays
+// calls beyond it according to the rate and refills up to the burst only.
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		rate  float64
+		burst int
+	}{
+		{rate: 10, burst: 10},
+		{rate: 20, burst: 20},
+		{rate: 0.5, burst: 1}, // Sub-1 rates still allow a single call
+	}
+	for _, tt := range tests {
+		limiter := newRateLimiter(tt.rate)
+		for i := 0; i < tt.burst; i++ {
+			if delay := limiter.wait(); delay != 0 {
+				t.Errorf("rate %v: call %d within burst delayed by %v", tt.rate, i, delay)
+			}
+		}
+		// Refilling for long must not exceed the burst
+		limiter.last = time.Now().Add(-time.Hour)
+		for i := 0; i < tt.burst; i++ {
+			if delay := limiter.wait(); delay != 0 {
+				t.Errorf("rate %v: call %d after refill delayed by %v", tt.rate, i, delay)
+			}
+		}
+		if limiter.tokens > 0.5 {
+			t.Errorf("rate %v: tokens left after burst: have %v, want none", tt.rate, limiter.tokens)
+		}
+	}
+	// Calls beyond the burst are delayed by about one refill period
+	limiter := newRateLimiter(10)
+	for i := 0; i < 10; i++ {
+		limiter.wait()
+	}
+	if delay := limiter.wait(); delay < 50*time.Millisecond || delay > 100*time.Millisecond {
+		t.Errorf("call beyond burst delay mismatch: have %v, want ~100ms", delay)
+	}
+}
@@ -0,0 +1,108 @@
+// This file contains the utility methods for initializing the clients of a
+// simulation from an explicitly requested genesis, instead of the simulator's own.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ethashEpochLength is the number of blocks an ethash DAG is valid for.
+const ethashEpochLength = 30000
+
+// genesisSpec is a validated genesis file to initialize the clients' chains with.
+type genesisSpec struct {
+	path  string // Host path of the genesis JSON file
+	epoch int    // Ethash epoch of the genesis block, selecting the DAG to generate
+}
+
+// loadGenesis reads a genesis JSON file and validates that it is usable by the
+// clients, failing fast on malformed files before any containers are started.
+func loadGenesis(path string) (*genesisSpec, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var genesis struct {
+		Config     map[string]interface{}     `json:"config"`
+		Number     json.RawMessage            `json:"number"`
+		Difficulty json.RawMessage            `json:"difficulty"`
+		GasLimit   json.RawMessage            `json:"gasLimit"`
+		Alloc      map[string]json.RawMessage `json:"alloc"`
+	}
+	if err := json.Unmarshal(blob, &genesis); err != nil {
+		return nil, fmt.Errorf("genesis %s: invalid JSON: %v", path, err)
+	}
+	if genesis.Config == nil {
+		return nil, fmt.Errorf("genesis %s: missing chain config", path)
+	}
+	if _, err := parseGenesisQuantity(genesis.Difficulty); err != nil {
+		return nil, fmt.Errorf("genesis %s: invalid difficulty: %v", path, err)
+	}
+	if _, err := parseGenesisQuantity(genesis.GasLimit); err != nil {
+		return nil, fmt.Errorf("genesis %s: invalid gas limit: %v", path, err)
+	}
+	number := uint64(0)
+	if len(genesis.Number) > 0 {
+		if number, err = parseGenesisQuantity(genesis.Number); err != nil {
+			return nil, fmt.Errorf("genesis %s: invalid block number: %v", path, err)
+		}
+	}
+	return &genesisSpec{path: path, epoch: int(number / ethashEpochLength)}, nil
+}
+
+// parseGenesisQuantity parses a numeric genesis field, which may be given as a
+// JSON number or a hex or decimal string.
+func parseGenesisQuantity(raw json.RawMessage) (uint64, error) {
+	if len(raw) == 0 {
+		return 0, fmt.Errorf("missing")
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err != nil {
+		text = string(raw)
+	}
+	if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") {
+		return strconv.ParseUint(text[2:], 16, 64)
+	}
+	return strconv.ParseUint(text, 10, 64)
+}
+
+// simulationDAGEpochs gathers the ethash epochs of the genesis blocks the clients
+// of the simulations matching pattern will be initialized with, so the DAGs of all
+// of them can be generated before any simulation starts. Simulations without an
+// explicit genesis need the DAG of the very first epoch.
+func simulationDAGEpochs(pattern string) ([]int, error) {
+	if genesisOverride != nil {
+		return []int{genesisOverride.epoch}, nil
+	}
+	simulators, err := listNestedImages("simulators", pattern)
+	if err != nil {
+		return nil, err
+	}
+	needed := make(map[int]bool)
+	for _, simulator := range simulators {
+		meta, err := loadTestMetadata("simulators", simulator)
+		if err != nil {
+			return nil, err
+		}
+		if genesis := meta.testGenesis(); genesis != nil {
+			needed[genesis.epoch] = true
+		} else {
+			needed[0] = true
+		}
+	}
+	if len(needed) == 0 {
+		needed[0] = true
+	}
+	epochs := make([]int, 0, len(needed))
+	for epoch := range needed {
+		epochs = append(epochs, epoch)
+	}
+	sort.Ints(epochs)
+	return epochs, nil
+}
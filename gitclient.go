@@ -0,0 +1,69 @@
+// This file contains the utility methods for registering ad-hoc clients whose
+// image definitions are cloned from remote git repositories.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// gitClients is the set of ad-hoc clients cloned from git repositories, mapping
+// the client names to the local folders holding their image definitions.
+var gitClients = make(map[string]string)
+
+// cloneGitClient shallow clones a client image definition from a git repository
+// specified as url#ref, optionally followed by :subpath if the Dockerfile is not
+// in the repository root. The client is registered under git/<repo> and built
+// alongside all the others. The returned closer deletes the local clone.
+func cloneGitClient(spec string) (func(), error) {
+	// Split the spec into its url, ref and subpath components
+	url, ref := spec, ""
+	if idx := strings.LastIndex(spec, "#"); idx >= 0 {
+		url, ref = spec[:idx], spec[idx+1:]
+	}
+	subpath := ""
+	if idx := strings.Index(ref, ":"); idx >= 0 {
+		ref, subpath = ref[:idx], ref[idx+1:]
+	}
+	if url == "" {
+		return nil, fmt.Errorf("invalid git client %q, want url#ref", spec)
+	}
+	name := "git/" + strings.TrimSuffix(path.Base(strings.TrimRight(url, "/")), ".git")
+	if _, ok := gitClients[name]; ok {
+		return nil, fmt.Errorf("duplicate git client %s", name)
+	}
+	// Shallow clone the requested ref into a temporary folder
+	dir, err := ioutil.TempDir("", "hive-client-")
+	if err != nil {
+		return nil, err
+	}
+	closer := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log15.Error("failed to delete git client clone", "client", name, "error", err)
+		}
+	}
+	args := []string{"clone", "--depth", "1"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	log15.Info("cloning git client", "client", name, "url", url, "ref", ref)
+	if out, err := exec.Command("git", append(args, url, dir)...).CombinedOutput(); err != nil {
+		closer()
+		return nil, fmt.Errorf("failed to clone %s: %v: %s", url, err, out)
+	}
+	context := filepath.Join(dir, filepath.FromSlash(subpath))
+	if _, err := os.Stat(filepath.Join(context, "Dockerfile")); err != nil {
+		closer()
+		return nil, fmt.Errorf("no Dockerfile in %s: %v", spec, err)
+	}
+	gitClients[name] = context
+	return closer, nil
+}
@@ -0,0 +1,156 @@
+// This file contains the utility methods for running the global setup and teardown
+// images, executed once per hive run around all the client tests.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// globalResult represents the results of a global setup or teardown run.
+type globalResult struct {
+	Start   time.Time `json:"start"`           // Time instance when the global run started
+	End     time.Time `json:"end"`             // Time instance when the global run ended
+	Success bool      `json:"success"`         // Whether the global run succeeded
+	Error   string    `json:"error,omitempty"` // Textual details to explain a failure
+}
+
+// globalSetupIP is the IP address of the live global setup container, if any. It
+// is forwarded into all tester containers so they may reach the shared fixtures.
+var globalSetupIP string
+
+// globalSetupEnvs returns the environment variables to inject into the tester
+// containers, exposing the global setup container if one is running.
+func globalSetupEnvs() []string {
+	if globalSetupIP == "" {
+		return nil
+	}
+	return []string{"HIVE_GLOBAL_SETUP_IP=" + globalSetupIP}
+}
+
+// buildGlobal builds the docker image for a global setup or teardown run.
+func buildGlobal(daemon *dockerClient, kind string, context string, cacher *buildCacher) (string, error) {
+	image := hiveImageNamespace + "/global/" + kind
+	return image, buildImage(daemon, image, context, cacher, log15.New("global", kind), "", nil)
+}
+
+// startGlobalSetup builds and starts the global setup container, leaving it alive
+// for the duration of the run. The setup is deemed successful if the container is
+// still running after startup, or if it already terminated with a zero exit code.
+//
+// The returned closer must be invoked after all tests finish to tear the setup
+// container down.
+func startGlobalSetup(daemon *dockerClient, context string, cacher *buildCacher) (*globalResult, func(), error) {
+	result := &globalResult{Start: time.Now()}
+	defer func() { result.End = time.Now() }()
+
+	logger := log15.New("global", "setup")
+	logger.Info("running global setup")
+
+	fail := func(err error) (*globalResult, func(), error) {
+		result.Error = err.Error()
+		return result, func() {}, err
+	}
+	image, err := buildGlobal(daemon, "setup", context, cacher)
+	if err != nil {
+		return fail(err)
+	}
+	c, err := daemon.CreateContainer(docker.CreateContainerOptions{Config: &docker.Config{Image: image}})
+	if err != nil {
+		logger.Error("failed to create global setup container", "error", err)
+		return fail(err)
+	}
+	logger = logger.New("id", c.ID[:8])
+	closer := func() {
+		logger.Debug("deleting global setup container")
+		globalSetupIP = ""
+		if err := daemon.RemoveContainer(docker.RemoveContainerOptions{ID: c.ID, Force: true}); err != nil {
+			logger.Error("failed to delete global setup container", "error", err)
+		}
+	}
+	waiter, err := runContainer(daemon, c.ID, logger, filepath.Join(*testResultsRoot, runPath, "global", "setup.log"), false, nil)
+	if err != nil {
+		logger.Error("failed to run global setup container", "error", err)
+		closer()
+		return fail(err)
+	}
+	go waiter.Wait()
+
+	// Check that the setup didn't fail outright and expose it to the testers
+	info, err := daemon.InspectContainer(c.ID)
+	if err != nil {
+		logger.Error("failed to inspect global setup container", "error", err)
+		closer()
+		return fail(err)
+	}
+	if !info.State.Running && info.State.ExitCode != 0 {
+		logger.Error("global setup failed", "exitcode", info.State.ExitCode)
+		closer()
+		return fail(fmt.Errorf("global setup exited with code %d", info.State.ExitCode))
+	}
+	globalSetupIP = info.NetworkSettings.IPAddress
+	logger.Info("global setup online", "ip", globalSetupIP)
+
+	result.Success = true
+	return result, closer, nil
+}
+
+// runGlobalTeardown builds and runs the global teardown container to completion,
+// reporting success based on its exit code.
+func runGlobalTeardown(daemon *dockerClient, context string, cacher *buildCacher) *globalResult {
+	result := &globalResult{Start: time.Now()}
+	defer func() { result.End = time.Now() }()
+
+	logger := log15.New("global", "teardown")
+	logger.Info("running global teardown")
+
+	image, err := buildGlobal(daemon, "teardown", context, cacher)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	c, err := daemon.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image: image,
+			Env:   globalSetupEnvs(),
+		},
+	})
+	if err != nil {
+		logger.Error("failed to create global teardown container", "error", err)
+		result.Error = err.Error()
+		return result
+	}
+	logger = logger.New("id", c.ID[:8])
+	defer func() {
+		logger.Debug("deleting global teardown container")
+		if err := daemon.RemoveContainer(docker.RemoveContainerOptions{ID: c.ID, Force: true}); err != nil {
+			logger.Error("failed to delete global teardown container", "error", err)
+		}
+	}()
+	waiter, err := runContainer(daemon, c.ID, logger, filepath.Join(*testResultsRoot, runPath, "global", "teardown.log"), false, nil)
+	if err != nil {
+		logger.Error("failed to run global teardown container", "error", err)
+		result.Error = err.Error()
+		return result
+	}
+	waiter.Wait()
+
+	info, err := daemon.InspectContainer(c.ID)
+	if err != nil {
+		logger.Error("failed to inspect global teardown container", "error", err)
+		result.Error = err.Error()
+		return result
+	}
+	if info.State.ExitCode != 0 {
+		logger.Error("global teardown failed", "exitcode", info.State.ExitCode)
+		result.Error = fmt.Sprintf("global teardown exited with code %d", info.State.ExitCode)
+		return result
+	}
+	result.Success = true
+	return result
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -11,12 +12,16 @@ import (
 	"strings"
 	"time"
 
-	"github.com/fsouza/go-dockerclient"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
 var (
-	dockerEndpoint = flag.String("docker-endpoint", "unix:///var/run/docker.sock", "Endpoint to the local Docker daemon")
+	dockerEndpoint  = flag.String("docker-endpoint", "unix:///var/run/docker.sock", "Endpoint to the Docker daemon (overrides DOCKER_HOST)")
+	dockerAPIRate   = flag.Float64("docker-api-rate", 0, "Maximum number of Docker API calls per second (0 = unlimited)")
+	dockerTLSCert   = flag.String("docker-tls-cert", "", "Client certificate to authenticate to a TLS secured Docker daemon with")
+	dockerTLSKey    = flag.String("docker-tls-key", "", "Client key to authenticate to a TLS secured Docker daemon with")
+	dockerTLSCA     = flag.String("docker-tls-ca", "", "CA certificate to verify a TLS secured Docker daemon against")
+	dockerReconnect = flag.Duration("docker-reconnect", 0, "Time window to keep retrying Docker API calls for while the daemon is unreachable (0 = fail immediately)")
 
 	//TODO - this needs to be passed on to the shell container if it is being used
 	dockerHostAlias = flag.String("docker-hostalias", "unix:///var/run/docker.sock", "Endpoint to the host Docket daemon from within a validator")
@@ -26,70 +31,224 @@ var (
 
 	noShellContainer = flag.Bool("docker-noshell", false, "Disable outer docker shell, running directly on the host")
 	noCachePattern   = flag.String("docker-nocache", "", "Regexp selecting the docker images to forcibly rebuild")
-
-	clientPattern = flag.String("client", "_master", "Regexp selecting the client(s) to run against")
-	overrideFiles = flag.String("override", "", "Comma separated regexp:files to override in client containers")
-	smokeFlag     = flag.Bool("smoke", false, "Whether to only smoke test or run full test suite")
+	buildRetries     = flag.Int("buildretries", 0, "Number of times to retry image builds and client container creations failing due to transient network errors")
+	goModCache       = flag.String("go-mod-cache", "", "Shared Go module proxy (GOPROXY) to pass as a build arg to all image builds")
+
+	clientPattern  = flag.String("client", "_master", "Regexp selecting the client(s) to run against")
+	maturityFlag   = flag.String("client-maturity", "", "Comma separated client maturity levels to run against (stable, beta, experimental; default all)")
+	clientGit      = flag.String("client-git", "", "Git repository of an ad-hoc client image definition to test, as url#ref[:subpath]")
+	overrideFiles  = flag.String("override", "", "Comma separated regexp:files to override in client containers")
+	verifyOverride = flag.Bool("verify-overrides", false, "Verify that all file overrides apply cleanly to their clients before running any tests")
+	clientMemory   = flag.String("client-memory", "", "Memory limit of every client container, as a byte count with an optional k, m or g suffix (default unlimited)")
+	clientCPUs     = flag.Float64("client-cpus", 0, "Number of (possibly fractional) CPU cores usable by every client container (default unlimited)")
+	clientLimits   *resourceLimits // Parsed -client-memory and -client-cpus, set after flag parsing
+	cleanupFlag    = flag.Bool("cleanup", false, "Remove the containers and dangling images left behind by killed hive runs before starting")
+	cleanupGrace   = flag.Duration("cleanup-grace", 24*time.Hour, "Age after which -cleanup removes the still running containers of other hive runs too")
+	exitCode       = flag.Bool("exitcode", true, "Exit with a non-zero code if any (non-experimental) test failed")
+	smokeFlag      = flag.Bool("smoke", false, "Whether to only smoke test or run full test suite")
+	dryRun         = flag.Bool("dryrun", false, "Only print the resolved client/test matrix as JSON, building and running nothing")
+	versionsOnly   = flag.Bool("versions-only", false, "Only retrieve and print the versions of the matched clients, running no tests")
+	syncModes      = flag.String("sync-modes", "", "Comma separated sync modes (HIVE_NODETYPE) to run every client validation and benchmark in")
 
 	validatorPattern = flag.String("test", ".", "Regexp selecting the validation tests to run")
+	testSkipPattern  = flag.String("test-skip", "", "Regexp selecting validation tests to skip, even if matched by -test")
 	simulatorPattern = flag.String("sim", "", "Regexp selecting the simulation tests to run")
+	simSkipPattern   = flag.String("sim-skip", "", "Regexp selecting simulation tests to skip, even if matched by -sim")
+	genesisFile      = flag.String("genesis", "", "Genesis JSON file to initialize the clients of all simulations with, overriding the simulators' own")
+	genesisOverride  *genesisSpec // Validated -genesis, set after flag parsing
 	benchmarkPattern = flag.String("bench", "", "Regexp selecting the benchmarks to run")
+	benchBaseline    = flag.String("bench-baseline", "", "Result file of a previous run to compare the benchmarks against, failing on regressions")
+	benchThreshold   = flag.Float64("bench-threshold", 10, "Percentage a benchmark may be slower than its -bench-baseline entry before failing")
+	benchBaselines   benchmarkBaseline // Parsed -bench-baseline, set after flag parsing
+	resultsFile      = flag.String("results", "", "File to write the JSON test results into (default stdout)")
+	streamFile       = flag.String("stream", "", "File to stream a JSON line per test into as each finishes (- for stdout, default disabled)")
+	coverageFile     = flag.String("coverage-report", "", "File to write a report of the client/test combinations run versus all discoverable ones")
+	junitFile        = flag.String("junit", "", "File to write the validation and simulation results into as JUnit XML")
+	influxFile       = flag.String("influx-file", "", "File to export the benchmark results into in InfluxDB line protocol")
+	metricsAddr      = flag.String("metrics-addr", "", "Address to serve Prometheus metrics of the run on (e.g. :9090, default disabled)")
+	webhookURL       = flag.String("webhook-url", "", "Webhook (e.g. Slack) to post a summary of the run to once all tests finished")
+	webhookTemplate  = flag.String("webhook-template", "", "Go text/template file to render the webhook payload from the run summary (default JSON summary)")
+	webhookTimeout   = flag.Duration("webhook-timeout", 30*time.Second, "Time limit for delivering the webhook summary, including all retries (0 = no limit)")
+	webhookSecret    = flag.String("webhook-secret", "", "Secret to sign the webhook payload with, sent as an HMAC-SHA256 in the X-Hive-Signature header")
+	resultURL        = flag.String("result-url", "", "Link to the full report of the run to include in the webhook summary")
+
+	shardFlag  = flag.String("shard", "", "Slice of the test matrix to run as i/n, deterministically partitioned by test and client names")
+	exportPlan = flag.String("export-plan", "", "File to write the resolved client/test plan into instead of running any tests")
+	planFile   = flag.String("plan", "", "File of a previously exported client/test plan to run instead of resolving patterns")
 
 	simulatorParallelism = flag.Int("sim-parallelism", 1, "Max number of parallel clients/containers to run tests against")
+	simStartParallelism  = flag.Int("sim-start-parallelism", 4, "Max number of simulation node containers to start concurrently")
+	parallelFlag         = flag.Int("parallel", 1, "Max number of client validations or simulations to run concurrently")
 	hiveDebug            = flag.Bool("debug", false, "A flag indicating debug mode, to allow docker containers to launch headless delve instances and so on")
+	dagCache             = flag.String("dagcache", "", "Folder to cache the generated ethash DAG in across runs (default regenerate every run)")
 	simRootContext       = flag.Bool("sim-rootcontext", false, "Indicates if the simulation should build the dockerfile with root (simulator) or local context. Needed for access to sibling folders like simulators/common")
 
+	globalSetup    = flag.String("global-setup-image", "", "Folder of a docker image to run once before all tests, kept alive as a shared fixture")
+	globalTeardown = flag.String("global-teardown-image", "", "Folder of a docker image to run once after all tests have finished")
+
 	loglevelFlag = flag.Int("loglevel", 3, "Log level to use for displaying system events")
+	logFormat    = flag.String("logformat", "terminal", "Log format to use for displaying system events (terminal, logfmt or json)")
+	logDir       = flag.String("logdir", "", "Folder to export the client logs of failed tests into, as <client>/<test>.log")
+	logAll       = flag.Bool("logall", false, "Export the client logs of passing tests into -logdir too")
+	logMaxBytes  = flag.Int64("log-max-bytes", 0, "Maximum number of bytes of output to retain per container log, keeping the tail (0 = unlimited)")
 
 	dockerTimeout         = flag.Int("dockertimeout", 10, "Time to wait for container to finish before stopping it")
-	dockerTimeoutDuration = time.Duration(*dockerTimeout) * time.Minute
+	dockerTimeoutDuration time.Duration // Parsed -dockertimeout, set after flag parsing
 	timeoutCheck          = flag.Int("timeoutcheck", 30, "Seconds to check for timeouts of containers")
-	timeoutCheckDuration  = time.Duration(*timeoutCheck) * time.Second
+	timeoutCheckDuration  time.Duration // Parsed -timeoutcheck, set after flag parsing
+
+	runPath      = time.Now().Format("20060102150405")
+	shellSummary = flag.String("shell-summary", "", "File to hand the run summary over to the outer shell in instead of logging it (internal)")
 
-	runPath = time.Now().Format("20060102150405")
+	mergeFiles  = flag.String("merge", "", "Comma separated result files to merge into one instead of running any tests")
+	mergeOutput = flag.String("o", "", "File to write the merged results into (default stdout)")
+
+	ulimits    ulimitList    // Resource limits to apply to all started containers
+	benchSweep resourceSweep // Memory and CPU limit points to run every benchmark at
+	buildArgs  buildArgList  // Build args to pass to the image builds of matching clients
 )
 
+func init() {
+	flag.Var(&ulimits, "ulimit", "Resource limit to apply to started containers as NAME=SOFT:HARD (repeatable)")
+	flag.Var(&buildArgs, "buildargs", "Comma separated client:KEY=VALUE build args to pass to matching client image builds (repeatable)")
+	flag.Var(&benchSweep, "bench-resource-sweep", "Semicolon separated memory=SIZE,cpus=N limit points to run every benchmark's client at")
+}
+
 func main() {
+	// Whatever happens, finish with a one-line summary of the run for log aggregators
+	start := time.Now()
+	results := new(resultSet)
+
+	summary, fail := runHive(results)
+	if terminated() {
+		fail = errTerminated
+	}
+	if summary == nil {
+		summary = summariseRun(results, "")
+		summary.finish(time.Since(start), fail)
+	}
+	if *shellSummary != "" {
+		if err := writeShellSummary(*shellSummary, summary); err != nil {
+			log15.Crit("failed to hand over run summary", "error", err)
+		}
+	} else {
+		logRunSummary(summary)
+	}
+	if fail != nil {
+		os.Exit(-1)
+	}
+}
+
+// runHive parses the flags and executes whatever hive mode they request, filling
+// in the results of any tests run. If hive ran within an outer shell container,
+// the summary handed over by the inner instance is returned too.
+func runHive(results *resultSet) (*runSummary, error) {
 	// Make sure hive can use multiple CPU cores when needed
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	// Parse the flags and configure the logger
 	flag.Parse()
-	log15.Root().SetHandler(log15.LvlFilterHandler(log15.Lvl(*loglevelFlag), log15.StreamHandler(os.Stderr, log15.TerminalFormat())))
+	dockerTimeoutDuration = time.Duration(*dockerTimeout) * time.Minute
+	timeoutCheckDuration = time.Duration(*timeoutCheck) * time.Second
+
+	format := log15.TerminalFormat()
+	switch *logFormat {
+	case "logfmt":
+		format = log15.LogfmtFormat()
+	case "json":
+		format = log15.JsonFormat()
+	}
+	log15.Root().SetHandler(log15.LvlFilterHandler(log15.Lvl(*loglevelFlag), log15.StreamHandler(os.Stderr, format)))
 
-	// Connect to the local docker daemon and make sure it works
-	daemon, err := docker.NewClient(*dockerEndpoint)
+	// If merging results was requested, do that without touching docker
+	if *mergeFiles != "" {
+		if err := mergeResultFiles(strings.Split(*mergeFiles, ","), *mergeOutput); err != nil {
+			log15.Crit("failed to merge result files", "error", err)
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	// Parse the test matrix shard to run, if any
+	var err error
+	if shard, err = parseShard(*shardFlag); err != nil {
+		log15.Crit("failed to parse shard selector", "error", err)
+		return nil, err
+	}
+	// Parse the resource limits of the client containers, if any
+	if clientLimits, err = parseClientLimits(*clientMemory, *clientCPUs); err != nil {
+		log15.Crit("failed to parse client resource limits", "error", err)
+		return nil, err
+	}
+	// Validate any requested genesis override before anything is built
+	if *genesisFile != "" {
+		if genesisOverride, err = loadGenesis(*genesisFile); err != nil {
+			log15.Crit("failed to load genesis override", "error", err)
+			return nil, err
+		}
+	}
+	// Load any requested benchmark baseline before running anything
+	if *benchBaseline != "" {
+		if benchBaselines, err = loadBenchmarkBaseline(*benchBaseline); err != nil {
+			log15.Crit("failed to load benchmark baseline", "error", err)
+			return nil, err
+		}
+	}
+	// Gather any client files needing overriding and make sure they all exist
+	overrides := []string{}
+	if *overrideFiles != "" {
+		overrides = strings.Split(*overrideFiles, ",")
+	}
+	if err := checkOverrideFiles(overrides); err != nil {
+		log15.Crit("failed to validate override files", "error", err)
+		return nil, err
+	}
+	// If only a dry run was requested, print the test matrix without touching docker
+	if *dryRun {
+		if err := dryRunMatrix(); err != nil {
+			log15.Crit("failed to resolve test matrix", "error", err)
+			return nil, err
+		}
+		return nil, nil
+	}
+	// Connect to the docker daemon and make sure it works
+	client, err := dialDocker()
 	if err != nil {
 		log15.Crit("failed to connect to docker deamon", "error", err)
-		return
+		return nil, err
 	}
+	daemon := newDockerClient(client, *dockerAPIRate, *dockerReconnect)
 	env, err := daemon.Version()
 	if err != nil {
 		log15.Crit("failed to retrieve docker version", "error", err)
-		return
+		return nil, err
 	}
 	log15.Info("docker daemon online", "version", env.Get("Version"))
 
-	// Gather any client files needing overriding and images not caching
-	overrides := []string{}
-	if *overrideFiles != "" {
-		overrides = strings.Split(*overrideFiles, ",")
+	// Make sure no containers of this run outlive it, even if it's killed
+	handleTermination(daemon)
+	defer func() {
+		if r := recover(); r != nil {
+			cleanupRun(daemon)
+			panic(r)
+		}
+	}()
+	// If requested, sweep anything left behind by previously killed runs
+	if *cleanupFlag {
+		cleanupStale(daemon)
 	}
+
+	// Gather any images not caching
 	cacher, err := newBuildCacher(*noCachePattern)
 	if err != nil {
 		log15.Crit("failed to parse nocache regexp", "error", err)
-		return
+		return nil, err
 	}
 	// Depending on the flags, either run hive in place or in an outer container shell
-	var fail error
 	if *noShellContainer {
-		fail = mainInHost(daemon, overrides, cacher)
-	} else {
-		fail = mainInShell(daemon, overrides, cacher)
-	}
-	if fail != nil {
-		os.Exit(-1)
+		return nil, mainInHost(daemon, overrides, cacher, results)
 	}
+	return mainInShell(daemon, overrides, cacher)
 }
 
 func makeTestOutputDirectory(testName string, testCategory string, clientTypes map[string]string) (string, error) {
@@ -141,6 +300,31 @@ func makeTestOutputDirectory(testName string, testCategory string, clientTypes m
 	return testRoot, nil
 }
 
+// reportResults flattens the results into indented JSON and writes them into the
+// file requested via -results, or prints them to stdout if none was.
+func reportResults(results *resultSet) ([]byte, error) {
+	out, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if *resultsFile == "" {
+		fmt.Println(string(out))
+		return out, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(*resultsFile), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(*resultsFile, out, 0644); err != nil {
+		return nil, err
+	}
+	log15.Info("test results written", "file", *resultsFile)
+	return out, nil
+}
+
+// errTestsFailed is returned from mainInHost if the run completed, but some tests
+// failed, to make hive exit with a non-zero code.
+var errTestsFailed = errors.New("tests failed")
+
 type summaryData struct {
 	Successes  int `json:"n_successes"` //Number of successes
 	Fails      int `json:"n_fails"`     //Number of fails
@@ -148,6 +332,8 @@ type summaryData struct {
 }
 
 type resultSet struct {
+	Setup       *globalResult                           `json:"setup,omitempty"`
+	Teardown    *globalResult                           `json:"teardown,omitempty"`
 	Clients     map[string]map[string]string            `json:"clients,omitempty"`
 	Validations map[string]map[string]*validationResult `json:"validations,omitempty"`
 	Simulations map[string]map[string]*simulationResult `json:"simulations,omitempty"`
@@ -180,7 +366,8 @@ func summariseResults(results *resultSet, detailFile string) resultSetSummary {
 				validationResult{Start: v2.Start,
 					End:     v2.End,
 					Success: v2.Success,
-					Error:   v2.Error},
+					Error:   v2.Error,
+					Skipped: v2.Skipped},
 				summaryData{Successes: 0, Fails: 0, Subresults: 1},
 			}
 
@@ -229,6 +416,8 @@ func summariseResults(results *resultSet, detailFile string) resultSetSummary {
 				End:     s2.End,
 				Success: s2.Success,
 				Error:   s2.Error,
+				Skipped: s2.Skipped,
+				NotRun:  s2.NotRun,
 			}
 
 			for _, sub := range s2.Subresults {
@@ -257,75 +446,208 @@ func summariseResults(results *resultSet, detailFile string) resultSetSummary {
 
 }
 
+// testPatterns returns the test selection patterns of the run per category.
+func testPatterns() map[string]string {
+	if *smokeFlag {
+		return map[string]string{"validator": "smoke", "simulator": "smoke", "benchmarker": "smoke"}
+	}
+	return map[string]string{
+		"validator":   *validatorPattern,
+		"simulator":   *simulatorPattern,
+		"benchmarker": *benchmarkPattern,
+	}
+}
+
+// skipPatterns returns the test skip patterns of the run per category.
+func skipPatterns() map[string]string {
+	return map[string]string{
+		"validator": *testSkipPattern,
+		"simulator": *simSkipPattern,
+	}
+}
+
 // mainInHost runs the actual hive validation, simulation and benchmarking on the
 // host machine itself. This is usually the path executed within an outer shell
 // container, but can be also requested directly.
-func mainInHost(daemon *docker.Client, overrides []string, cacher *buildCacher) error {
-	results := resultSet{}
+func mainInHost(daemon *dockerClient, overrides []string, cacher *buildCacher, results *resultSet) (fail error) {
+	// Expose the progress of the run as metrics if requested
+	if *metricsAddr != "" {
+		closer, err := startMetricsServer(*metricsAddr)
+		if err != nil {
+			log15.Crit("failed to start metrics server", "error", err)
+			return err
+		}
+		defer closer()
+	}
+	// Clone any ad-hoc client requested straight from a git repository
+	if *clientGit != "" {
+		closer, err := cloneGitClient(*clientGit)
+		if err != nil {
+			log15.Crit("failed to clone git client", "error", err)
+			return err
+		}
+		defer closer()
+	}
+	// Make sure all requested client build args apply to some client
+	if err := buildArgs.check(); err != nil {
+		log15.Crit("failed to validate build args", "error", err)
+		return err
+	}
+	// If only the client versions were requested, report them and return
+	if *versionsOnly {
+		versions, err := fetchClientVersions(daemon, *clientPattern, cacher)
+		if err != nil {
+			log15.Crit("failed to retrieve client versions", "error", err)
+			return err
+		}
+		out, err := json.MarshalIndent(versions, "", "  ")
+		if err != nil {
+			log15.Crit("failed to report client versions", "error", err)
+			return err
+		}
+		fmt.Println(string(out))
+
+		// Failed clients only carry an error entry in the report, so signal them too
+		if len(clientFailures) > 0 {
+			log15.Crit("failed to retrieve some client versions", "failed", len(clientFailures))
+			return fmt.Errorf("failed to retrieve the versions of %d clients", len(clientFailures))
+		}
+		return nil
+	}
+	// If only the test plan was requested, resolve and export it
+	if *exportPlan != "" {
+		plan, err := resolveTestPlan(*clientPattern, testPatterns())
+		if err != nil {
+			log15.Crit("failed to resolve test plan", "error", err)
+			return err
+		}
+		if err := writeTestPlan(*exportPlan, plan); err != nil {
+			log15.Crit("failed to export test plan", "error", err)
+			return err
+		}
+		log15.Info("test plan exported", "file", *exportPlan, "entries", len(plan.Entries))
+		return nil
+	}
+	// If a pre-resolved test plan was requested, run exactly that
+	if *planFile != "" {
+		if err := applyTestPlan(*planFile); err != nil {
+			log15.Crit("failed to load test plan", "error", err)
+			return err
+		}
+	}
 	var err error
 
+	// Stream the individual test results as they finish if requested
+	stream, err := openResultStream(*streamFile)
+	if err != nil {
+		log15.Crit("failed to open result stream", "error", err)
+		return err
+	}
+	defer stream.close()
+
+	// Whatever happens, notify any webhook of the outcome
+	start := time.Now()
+	defer func() {
+		notifyWebhook(results, time.Since(start), fail)
+	}()
+
+	// Run any global setup before touching the clients, bailing out if it fails
+	if *globalSetup != "" {
+		setup, closer, err := startGlobalSetup(daemon, *globalSetup, cacher)
+		results.Setup = setup
+		if err != nil {
+			log15.Crit("failed to run global setup", "error", err)
+			return err
+		}
+		defer closer()
+	}
+	// Run any global teardown once the tests finished, however the run ends. It is
+	// deferred after the setup's closer, so the setup's fixture outlives it.
+	tornDown := false
+	teardown := func() {
+		if *globalTeardown != "" && !tornDown {
+			tornDown = true
+			results.Teardown = runGlobalTeardown(daemon, *globalTeardown, cacher)
+		}
+	}
+	defer teardown()
+
 	// Retrieve the versions of all clients being tested
 	if results.Clients, err = fetchClientVersions(daemon, *clientPattern, cacher); err != nil {
 		log15.Crit("failed to retrieve client versions", "error", err)
-		b, ok := err.(*buildError)
-		if ok {
-			results.Clients = make(map[string]map[string]string)
-			results.Clients[b.Client()] = map[string]string{"error": b.Error()}
-			out, errMarshal := json.MarshalIndent(results, "", "  ")
-			if errMarshal != nil {
-				log15.Crit("failed to report results. Docker Failed build.", "error", err)
-				return err
+		if len(results.Clients) > 0 {
+			teardown()
+			if _, errReport := reportResults(results); errReport != nil {
+				log15.Crit("failed to report results. Docker Failed build.", "error", errReport)
 			}
-			fmt.Println(string(out))
 		}
 		return err
 	}
+	// If requested, make sure all the file overrides apply cleanly before testing
+	if *verifyOverride && len(overrides) > 0 {
+		clients, err := buildClients(daemon, *clientPattern, cacher)
+		if err != nil {
+			log15.Crit("failed to build clients for override verification", "error", err)
+			return err
+		}
+		if err = verifyOverrides(daemon, clients, overrides); err != nil {
+			log15.Crit("failed to verify file overrides", "error", err)
+			return err
+		}
+		log15.Info("file overrides verified", "overrides", len(overrides), "clients", len(clients))
+	}
 	// Smoke tests are exclusive with all other flags
 	if *smokeFlag {
-		if results.Validations, err = validateClients(daemon, *clientPattern, "smoke", overrides, cacher); err != nil {
+		if results.Validations, err = validateClients(daemon, *clientPattern, "smoke", overrides, cacher, stream.report); err != nil {
 			log15.Crit("failed to smoke-validate client images", "error", err)
 			return err
 		}
-		if results.Simulations, err = simulateClients(daemon, *clientPattern, "smoke", overrides, cacher); err != nil {
+		if results.Simulations, err = simulateClients(daemon, *clientPattern, "smoke", overrides, cacher, stream.report); err != nil {
 			log15.Crit("failed to smoke-simulate client images", "error", err)
 			return err
 		}
-		if results.Benchmarks, err = benchmarkClients(daemon, *clientPattern, "smoke", overrides, cacher); err != nil {
+		if results.Benchmarks, err = benchmarkClients(daemon, *clientPattern, "smoke", overrides, cacher, stream.report); err != nil {
 			log15.Crit("failed to smoke-benchmark client images", "error", err)
 			return err
 		}
 	} else {
 		// Otherwise run all requested validation and simulation tests
 		if *validatorPattern != "" {
-			if results.Validations, err = validateClients(daemon, *clientPattern, *validatorPattern, overrides, cacher); err != nil {
+			if results.Validations, err = validateClients(daemon, *clientPattern, *validatorPattern, overrides, cacher, stream.report); err != nil {
 				log15.Crit("failed to validate clients", "error", err)
 				return err
 			}
 		}
 		if *simulatorPattern != "" {
-			if err = makeGenesisDAG(daemon, cacher); err != nil {
+			epochs, err := simulationDAGEpochs(*simulatorPattern)
+			if err != nil {
+				log15.Crit("failed to resolve simulation genesis epochs", "error", err)
+				return err
+			}
+			if err = makeGenesisDAG(daemon, cacher, epochs); err != nil {
 				log15.Crit("failed generate DAG for simulations", "error", err)
 				return err
 			}
-			if results.Simulations, err = simulateClients(daemon, *clientPattern, *simulatorPattern, overrides, cacher); err != nil {
+			if results.Simulations, err = simulateClients(daemon, *clientPattern, *simulatorPattern, overrides, cacher, stream.report); err != nil {
 				log15.Crit("failed to simulate clients", "error", err)
 				return err
 			}
 		}
 		if *benchmarkPattern != "" {
-			if results.Benchmarks, err = benchmarkClients(daemon, *clientPattern, *benchmarkPattern, overrides, cacher); err != nil {
+			if results.Benchmarks, err = benchmarkClients(daemon, *clientPattern, *benchmarkPattern, overrides, cacher, stream.report); err != nil {
 				log15.Crit("failed to benchmark clients", "error", err)
 				return err
 			}
 		}
 	}
-	// Flatten the results and print them in JSON form
-	out, err := json.MarshalIndent(results, "", "  ")
+	// Run any global teardown now that all the tests finished
+	teardown()
+	// Flatten the results and report them in JSON form
+	out, err := reportResults(results)
 	if err != nil {
 		log15.Crit("failed to report results", "error", err)
 		return err
 	}
-	fmt.Println(string(out))
 
 	//send the output to a file as log.json in the run root
 	logFileName := filepath.Join(*testResultsRoot, runPath, "log.json")
@@ -339,14 +661,36 @@ func mainInHost(daemon *docker.Client, overrides []string, cacher *buildCacher)
 	}
 	logFile.Close()
 
+	// If requested, report which of all the possible client/test combinations ran
+	if *coverageFile != "" {
+		if err := writeCoverageReport(*coverageFile, results, *clientPattern, testPatterns()); err != nil {
+			log15.Crit("failed to report test coverage", "error", err)
+			return err
+		}
+	}
+	// If requested, export the test results for CI dashboards too
+	if *junitFile != "" {
+		if err := writeJUnitReport(*junitFile, results); err != nil {
+			log15.Crit("failed to export JUnit results", "error", err)
+			return err
+		}
+	}
+	// If requested, export the benchmark results for time-series databases too
+	if *influxFile != "" && len(results.Benchmarks) > 0 {
+		if err := writeInfluxBenchmarks(*influxFile, results.Benchmarks, time.Now()); err != nil {
+			log15.Crit("failed to export benchmark results", "error", err)
+			return err
+		}
+	}
+
 	//process the output into a summary and append it to the summary index
-	resultSummary := summariseResults(&results, filepath.Join(runPath, "log.json"))
+	resultSummary := summariseResults(results, filepath.Join(runPath, "log.json"))
 
 	summaryFileName := filepath.Join(*testResultsRoot, *testResultsSummaryFile)
 
 	var allSummaryInfo summaryFile
 	//read the existing summary data, if present
-	if summaryFileData, err := ioutil.ReadFile(summaryFileName); err == nil{
+	if summaryFileData, err := ioutil.ReadFile(summaryFileName); err == nil {
 		//back it up
 		ioutil.WriteFile(summaryFileName+".bak", summaryFileData, 0644)
 		//deserialize from json
@@ -372,6 +716,9 @@ func mainInHost(daemon *docker.Client, overrides []string, cacher *buildCacher)
 		log15.Crit("failed to report summarised results", "error", err)
 		return err
 	}
-
+	// Unless disabled, signal any test failures through the exit code too
+	if summary := summariseRun(results, ""); *exitCode && !summary.Success {
+		return errTestsFailed
+	}
 	return nil
 }
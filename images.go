@@ -9,10 +9,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	"gopkg.in/inconshreveable/log15.v2"
@@ -48,90 +51,210 @@ func newBuildCacher(pattern string) (*buildCacher, error) {
 
 // buildShell builds the outer shell docker image for running the entirety of hive
 // within an all encompassing container.
-func buildShell(daemon *docker.Client, cacher *buildCacher) (string, error) {
+func buildShell(daemon *dockerClient, cacher *buildCacher) (string, error) {
 	image := hiveImageNamespace + "/shell"
-	return image, buildImage(daemon, image, ".", cacher, log15.Root(), "")
+	return image, buildImage(daemon, image, ".", cacher, log15.Root(), "", nil)
 }
 
 // buildEthash builds the ethash DAG generator docker image to run before any real
 // simulation needing it takes place.
-func buildEthash(daemon *docker.Client, cacher *buildCacher) (string, error) {
+func buildEthash(daemon *dockerClient, cacher *buildCacher) (string, error) {
 	image := hiveImageNamespace + "/internal/ethash"
-	return image, buildImage(daemon, image, filepath.Join("internal", "ethash"), cacher, log15.Root(), "")
+	return image, buildImage(daemon, image, filepath.Join("internal", "ethash"), cacher, log15.Root(), "", nil)
 }
 
+// clientFailures are the clients whose images failed to build (or to report their
+// version) during the run. They are recorded once and then left out of all later
+// test phases, instead of a single broken client aborting the entire run.
+var clientFailures = make(map[string]error)
+
 // buildClients iterates over all the known clients and builds a docker image for
-// all unknown ones matching the given pattern.
-func buildClients(daemon *docker.Client, pattern string, cacher *buildCacher) (map[string]string, error) {
-	return buildNestedImages(daemon, "clients", pattern, "client", cacher, false)
+// all unknown ones matching the given pattern (and requested maturity levels), as
+// well as for all the ad-hoc ones cloned from git repositories. Clients failing to
+// build are recorded in clientFailures and skipped, only an unreachable docker
+// daemon aborts the build.
+func buildClients(daemon *dockerClient, pattern string, cacher *buildCacher) (map[string]string, error) {
+	names, err := listClients(pattern)
+	if err != nil {
+		return nil, err
+	}
+	clients := make(map[string]string)
+	for _, name := range names {
+		if _, failed := clientFailures[name]; failed {
+			continue
+		}
+		var images map[string]string
+		if context, ok := gitClients[name]; ok {
+			// Ad-hoc clients cloned from git are built straight from their clone
+			image := hiveImageNamespace + "/clients/" + name
+			start := time.Now()
+			if err = buildImage(daemon, image, context, cacher, log15.New("client", name), "", buildArgs.forClient(name)); err == nil {
+				buildDurationMetric.observe(metricLabels("kind", "client"), time.Since(start).Seconds())
+				clientsBuiltMetric.inc("")
+				images = map[string]string{name: image}
+			} else {
+				err = &buildError{err: fmt.Errorf("%s: %w", context, err), client: name}
+			}
+		} else {
+			images, err = buildImages(daemon, "clients", []string{name}, "client", cacher, false)
+		}
+		if err != nil {
+			// If the docker daemon is gone, no other client will build either
+			if transientDockerError(err) {
+				return nil, err
+			}
+			log15.Error("client failed to build, skipping it", "client", name, "error", err)
+			clientFailures[name] = err
+			continue
+		}
+		clients[name] = images[name]
+	}
+	return clients, nil
+}
+
+// listClients lists all the known clients matching the given pattern (and requested
+// maturity levels), along with all the ad-hoc ones cloned from git repositories.
+func listClients(pattern string) ([]string, error) {
+	// If only certain client maturity levels were requested, drop all others
+	if *maturityFlag != "" {
+		var err error
+		if pattern, err = maturityPattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+	names, err := listNestedImages("clients", pattern)
+	if err != nil {
+		return nil, err
+	}
+	for name := range gitClients {
+		names = append(names, name)
+	}
+	return names, nil
 }
 
 // fetchClientVersions downloads the version json specs from all clients that
-// match the given patten.
-func fetchClientVersions(daemon *docker.Client, pattern string, cacher *buildCacher) (map[string]map[string]string, error) {
+// match the given patten. Clients failing to build or to report their version
+// get an error entry instead and are excluded from all later test phases. Only
+// fatal failures (e.g. the docker daemon being gone) are returned as an error,
+// along with the versions collected up to that point.
+func fetchClientVersions(daemon *dockerClient, pattern string, cacher *buildCacher) (map[string]map[string]string, error) {
 	// Build all the client that we need the versions of
+	versions := make(map[string]map[string]string)
 	clients, err := buildClients(daemon, pattern, cacher)
+	for client, failure := range clientFailures {
+		versions[client] = map[string]string{"error": failure.Error()}
+	}
 	if err != nil {
-		return nil, err
+		if berr, ok := err.(*buildError); ok {
+			versions[berr.Client()] = map[string]string{"error": berr.Error()}
+		}
+		return versions, err
 	}
 	// Iterate over the images and collect the versions
-	versions := make(map[string]map[string]string)
 	for client, image := range clients {
 		logger := log15.New("client", client)
 
-		blob, err := downloadFromImage(daemon, image, "/version.json", logger)
-		if err != nil {
-			berr := &buildError{err: err, client: client}
-			return nil, berr
+		var blob []byte
+		err := retryBuild(logger, func() (err error) {
+			blob, err = downloadFromImage(daemon, image, "/version.json", logger)
+			return err
+		})
+		if err != nil && transientDockerError(err) {
+			versions[client] = map[string]string{"error": err.Error()}
+			return versions, &buildError{err: err, client: client}
 		}
 		var version map[string]string
-		if err := json.Unmarshal(blob, &version); err != nil {
-			berr := &buildError{err: err, client: client}
-			return nil, berr
+		if err == nil {
+			err = json.Unmarshal(blob, &version)
+		}
+		if err != nil {
+			logger.Error("client failed to report its version, skipping it", "error", err)
+			clientFailures[client] = err
+			versions[client] = map[string]string{"error": err.Error()}
+			continue
+		}
+		// If the image didn't report its source commit, try to find it out locally
+		if version["commit"] == "" {
+			if commit := clientCommit(client, logger); commit != "" {
+				if version == nil {
+					version = make(map[string]string)
+				}
+				version["commit"] = commit
+			}
 		}
 		versions[client] = version
 	}
 	return versions, nil
 }
 
+// clientCommit attempts to determine the source commit a client image was built
+// from, for images not reporting it in their version spec. Ad-hoc git clients are
+// queried from their clone, other clients via an optional commit.sh script in the
+// client folder printing the commit hash. An empty string is returned if the
+// commit cannot be determined.
+func clientCommit(client string, logger log15.Logger) string {
+	var cmd *exec.Cmd
+	if context, ok := gitClients[client]; ok {
+		cmd = exec.Command("git", "rev-parse", "HEAD")
+		cmd.Dir = context
+	} else {
+		dir := filepath.Join("clients", client)
+		if _, err := os.Stat(filepath.Join(dir, "commit.sh")); err != nil {
+			return ""
+		}
+		cmd = exec.Command("sh", "commit.sh")
+		cmd.Dir = dir
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		logger.Warn("failed to retrieve client commit", "error", err)
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
 // buildValidators iterates over all the known validators and builds a docker image
-// for all unknown ones matching the given pattern.
-func buildValidators(daemon *docker.Client, pattern string, cacher *buildCacher) (map[string]string, error) {
-	images, err := buildNestedImages(daemon, "validators", pattern, "validator", cacher, false)
-	return images, err
+// for all unknown ones matching the given pattern, but not the skip pattern. The
+// names of the skipped validators are returned alongside the images.
+func buildValidators(daemon *dockerClient, pattern string, skip string, cacher *buildCacher) (map[string]string, []string, error) {
+	names, err := listNestedImages("validators", pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+	names, skipped, err := skipNestedImages("validators", names, skip)
+	if err != nil {
+		return nil, nil, err
+	}
+	images, err := buildImages(daemon, "validators", names, "validator", cacher, false)
+	return images, skipped, err
 }
 
 // buildSimulators iterates over all the known simulators and builds a docker image
-// for all unknown ones matching the given pattern.
-func buildSimulators(daemon *docker.Client, pattern string, cacher *buildCacher) (map[string]string, error) {
-	images, err := buildNestedImages(daemon, "simulators", pattern, "simulator", cacher, *simRootContext)
-	return images, err
+// for all unknown ones matching the given pattern, but not the skip pattern. The
+// names of the skipped simulators are returned alongside the images.
+func buildSimulators(daemon *dockerClient, pattern string, skip string, cacher *buildCacher) (map[string]string, []string, error) {
+	names, err := listNestedImages("simulators", pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+	names, skipped, err := skipNestedImages("simulators", names, skip)
+	if err != nil {
+		return nil, nil, err
+	}
+	images, err := buildImages(daemon, "simulators", names, "simulator", cacher, *simRootContext)
+	return images, skipped, err
 }
 
 // buildBenchmarkers iterates over all the known benchmarkers and builds a docker image
 // for all unknown ones matching the given pattern.
-func buildBenchmarkers(daemon *docker.Client, pattern string, cacher *buildCacher) (map[string]string, error) {
+func buildBenchmarkers(daemon *dockerClient, pattern string, cacher *buildCacher) (map[string]string, error) {
 	images, err := buildNestedImages(daemon, "benchmarkers", pattern, "benchmarker", cacher, false)
 	return images, err
 }
 
-// buildNestedImages iterates over a directory containing arbitrarilly nested
-// docker image definitions and builds all of them matching the provided pattern.
-func buildNestedImages(daemon *docker.Client, root string, pattern string, kind string, cacher *buildCacher, rootContext bool) (map[string]string, error) {
-
-	var contextBuilder func(root string, path string) (string, string)
-
-	if rootContext {
-		contextBuilder = func(root string, path string) (string, string) {
-			return root, strings.Replace(path+string(filepath.Separator)+"Dockerfile", "\\", "/", -1)
-		}
-	} else {
-		contextBuilder = func(root string, path string) (string, string) {
-			return filepath.Join(root, path), ""
-		}
-	}
-
-	// Gather all the folders with Dockerfiles within them
+// listNestedImages iterates over a directory containing arbitrarilly nested
+// docker image definitions and lists all of them matching the provided pattern.
+func listNestedImages(root string, pattern string) ([]string, error) {
 	re, err := regexp.Compile(pattern)
 	if err != nil {
 		return nil, err
@@ -154,6 +277,62 @@ func buildNestedImages(daemon *docker.Client, root string, pattern string, kind
 	}); err != nil {
 		return nil, err
 	}
+	return names, nil
+}
+
+// skipNestedImages splits a list of image definitions nested within a root
+// directory into the ones to keep and the ones matching the skip pattern. The
+// skip pattern is matched the same way as the pattern of listNestedImages, and
+// an empty one skips nothing.
+func skipNestedImages(root string, names []string, skip string) ([]string, []string, error) {
+	if skip == "" {
+		return names, nil, nil
+	}
+	matches, err := listNestedImages(root, skip)
+	if err != nil {
+		return nil, nil, err
+	}
+	drop := make(map[string]bool)
+	for _, name := range matches {
+		drop[name] = true
+	}
+	var keep, skipped []string
+	for _, name := range names {
+		if drop[name] {
+			skipped = append(skipped, name)
+		} else {
+			keep = append(keep, name)
+		}
+	}
+	return keep, skipped, nil
+}
+
+// buildNestedImages iterates over a directory containing arbitrarilly nested
+// docker image definitions and builds all of them matching the provided pattern.
+func buildNestedImages(daemon *dockerClient, root string, pattern string, kind string, cacher *buildCacher, rootContext bool) (map[string]string, error) {
+	// Gather all the folders with Dockerfiles within them
+	names, err := listNestedImages(root, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return buildImages(daemon, root, names, kind, cacher, rootContext)
+}
+
+// buildImages builds the docker images of a list of image definitions nested
+// within a root directory.
+func buildImages(daemon *dockerClient, root string, names []string, kind string, cacher *buildCacher, rootContext bool) (map[string]string, error) {
+	var contextBuilder func(root string, path string) (string, string)
+
+	if rootContext {
+		contextBuilder = func(root string, path string) (string, string) {
+			return root, strings.Replace(path+string(filepath.Separator)+"Dockerfile", "\\", "/", -1)
+		}
+	} else {
+		contextBuilder = func(root string, path string) (string, string) {
+			return filepath.Join(root, path), ""
+		}
+	}
+
 	// Iterate over all the matched specs and build their docker images
 	images := make(map[string]string)
 	for _, name := range names {
@@ -162,10 +341,19 @@ func buildNestedImages(daemon *docker.Client, root string, pattern string, kind
 			image               = strings.Replace(filepath.Join(hiveImageNamespace, root, name), string(os.PathSeparator), "/", -1)
 			logger              = log15.New(kind, name)
 		)
-		if err := buildImage(daemon, image, context, cacher, logger, dockerfile); err != nil {
-			berr := &buildError{err: fmt.Errorf("%s: %v", context, err), client: name}
+		var args []docker.BuildArg
+		if kind == "client" {
+			args = buildArgs.forClient(name)
+		}
+		start := time.Now()
+		if err := buildImage(daemon, image, context, cacher, logger, dockerfile, args); err != nil {
+			berr := &buildError{err: fmt.Errorf("%s: %w", context, err), client: name}
 			return nil, berr
 		}
+		buildDurationMetric.observe(metricLabels("kind", kind), time.Since(start).Seconds())
+		if kind == "client" {
+			clientsBuiltMetric.inc("")
+		}
 		images[name] = image
 	}
 	return images, nil
@@ -184,8 +372,13 @@ func (b *buildError) Client() string {
 	return b.client
 }
 
-// buildImage builds a single docker image from the specified context.
-func buildImage(daemon *docker.Client, image, context string, cacher *buildCacher, logger log15.Logger, dockerfile string) error {
+func (b *buildError) Unwrap() error {
+	return b.err
+}
+
+// buildImage builds a single docker image from the specified context, passing the
+// given build args (e.g. from -buildargs) to the Dockerfile.
+func buildImage(daemon *dockerClient, image, context string, cacher *buildCacher, logger log15.Logger, dockerfile string, args []docker.BuildArg) error {
 	var nocache bool
 	if cacher != nil && cacher.pattern.MatchString(image) && !cacher.rebuilt[image] {
 		cacher.rebuilt[image] = true
@@ -208,17 +401,149 @@ func buildImage(daemon *docker.Client, image, context string, cacher *buildCache
 		Dockerfile:   dockerfile,
 		OutputStream: stream,
 		NoCache:      nocache,
+		BuildArgs:    args,
+
+		ForceRmTmpContainer: true, // Don't leave intermediate containers of failed builds behind
+	}
+	// If a shared Go module proxy was requested, point the build at it
+	if *goModCache != "" {
+		opts.BuildArgs = append(opts.BuildArgs, docker.BuildArg{Name: "GOPROXY", Value: *goModCache})
 	}
-	if err := daemon.BuildImage(opts); err != nil {
+	if err := retryBuild(logger, func() error { return daemon.BuildImage(opts) }); err != nil {
 		logger.Error("failed to build docker image", "error", err)
 		return err
 	}
 	return nil
 }
 
+// transientBuildErrors are fragments of image build failures caused by network
+// hiccups (e.g. pulling a base image or package from a registry), as opposed to
+// permanent ones such as Dockerfile or compilation errors.
+var transientBuildErrors = []string{
+	"connection reset",
+	"connection refused",
+	"i/o timeout",
+	"tls handshake timeout",
+	"unexpected eof",
+	"no such host",
+	"temporary failure in name resolution",
+	"service unavailable",
+	"toomanyrequests",
+	"client.timeout exceeded",
+}
+
+// transientBuildError checks whether an image build or container creation failure
+// was caused by a network error worth retrying. An unreachable docker daemon is
+// not, as every docker call already retries that for the -docker-reconnect window.
+func transientBuildError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, fragment := range transientBuildErrors {
+		if strings.Contains(msg, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxBuildBackoff caps the exponentially growing wait between retried builds.
+const maxBuildBackoff = time.Minute
+
+// retryBuild runs an image build (or other image operation, such as creating a
+// container), retrying it with exponential backoff up to -buildretries times if
+// it failed transiently.
+func retryBuild(logger log15.Logger, fn func() error) error {
+	delay := newBackoff(2*time.Second, maxBuildBackoff)
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > *buildRetries || !transientBuildError(err) {
+			return err
+		}
+		logger.Info("retrying failed image operation", "attempt", attempt+1, "backoff", delay.next(), "error", err)
+		delay.wait()
+	}
+}
+
+// clientBuildArg is a single build arg to pass to the image builds of the clients
+// matching a pattern.
+type clientBuildArg struct {
+	pattern *regexp.Regexp
+	arg     docker.BuildArg
+}
+
+// buildArgList is a repeatable command line flag collecting the build args to pass
+// to client image builds, each in the form of client:KEY=VALUE, where client is a
+// regexp matched against the client names.
+type buildArgList []clientBuildArg
+
+// String implements flag.Value, formatting the build args back into flag form.
+func (l *buildArgList) String() string {
+	args := make([]string, 0, len(*l))
+	for _, arg := range *l {
+		args = append(args, fmt.Sprintf("%s:%s=%s", arg.pattern, arg.arg.Name, arg.arg.Value))
+	}
+	return strings.Join(args, ",")
+}
+
+// Set implements flag.Value, parsing a comma separated list of client:KEY=VALUE
+// build args.
+func (l *buildArgList) Set(value string) error {
+	for _, spec := range strings.Split(value, ",") {
+		idx := strings.Index(spec, ":")
+		if idx <= 0 {
+			return fmt.Errorf("invalid build arg %q, want client:KEY=VALUE", spec)
+		}
+		pattern, err := regexp.Compile(spec[:idx])
+		if err != nil {
+			return fmt.Errorf("invalid build arg client pattern %q: %v", spec[:idx], err)
+		}
+		parts := strings.SplitN(spec[idx+1:], "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid build arg %q, want client:KEY=VALUE", spec)
+		}
+		*l = append(*l, clientBuildArg{pattern: pattern, arg: docker.BuildArg{Name: parts[0], Value: parts[1]}})
+	}
+	return nil
+}
+
+// check ensures that every build arg applies to at least one known client, to
+// catch typos in client names instead of silently building without the arg.
+func (l buildArgList) check() error {
+	clients, err := listNestedImages("clients", ".")
+	if err != nil {
+		return err
+	}
+	for client := range gitClients {
+		clients = append(clients, client)
+	}
+	for _, arg := range l {
+		matched := false
+		for _, client := range clients {
+			if arg.pattern.MatchString(client) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("build arg %s matches no known client %q", arg.arg.Name, arg.pattern)
+		}
+	}
+	return nil
+}
+
+// forClient returns the build args applying to a client.
+func (l buildArgList) forClient(client string) []docker.BuildArg {
+	var args []docker.BuildArg
+	for _, arg := range l {
+		if arg.pattern.MatchString(client) {
+			args = append(args, arg.arg)
+		}
+	}
+	return args
+}
+
 // downloadFromImage retrieves a file from a docker image. To do so it creates a
 // temporary container, downloads the file from it and destroys the container.
-func downloadFromImage(daemon *docker.Client, image, path string, logger log15.Logger) ([]byte, error) {
+func downloadFromImage(daemon *dockerClient, image, path string, logger log15.Logger) ([]byte, error) {
 	// Create the temporary container and ensure it's cleaned up
 	cont, err := daemon.CreateContainer(docker.CreateContainerOptions{Config: &docker.Config{Image: image}})
 	if err != nil {
@@ -254,3 +579,30 @@ func downloadFromImage(daemon *docker.Client, image, path string, logger log15.L
 		}
 	}
 }
+
+// existsInImage checks whether a path exists within a docker image. To do so it
+// creates a temporary container, attempts to download the path and destroys the
+// container.
+func existsInImage(daemon *dockerClient, image, path string, logger log15.Logger) (bool, error) {
+	// Create the temporary container and ensure it's cleaned up
+	cont, err := daemon.CreateContainer(docker.CreateContainerOptions{Config: &docker.Config{Image: image}})
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := daemon.RemoveContainer(docker.RemoveContainerOptions{ID: cont.ID, Force: true}); err != nil {
+			logger.Error("failed to delete temporary container", "id", cont.ID[:8], "error", err)
+		}
+	}()
+	// Try to download the path, discarding its contents
+	if err := daemon.DownloadFromContainer(cont.ID, docker.DownloadFromContainerOptions{
+		Path:         path,
+		OutputStream: ioutil.Discard,
+	}); err != nil {
+		if derr, ok := err.(*docker.Error); ok && derr.Status == 404 {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Tests that client build args are parsed from their flag form, including comma
+// separated batches, and invalid ones rejected.
+func TestBuildArgListSet(t *testing.T) {
+	tests := []struct {
+		value    string
+		patterns []string
+		args     []docker.BuildArg
+		fail     bool
+	}{
+		{"go-ethereum:GO_VERSION=1.10", []string{"go-ethereum"}, []docker.BuildArg{{Name: "GO_VERSION", Value: "1.10"}}, false},
+		{"geth.*:A=1,parity:B=", []string{"geth.*", "parity"}, []docker.BuildArg{{Name: "A", Value: "1"}, {Name: "B", Value: ""}}, false},
+		{"go-ethereum:URL=http://x?a=b", []string{"go-ethereum"}, []docker.BuildArg{{Name: "URL", Value: "http://x?a=b"}}, false},
+		{"GO_VERSION=1.10", nil, nil, true},
+		{":GO_VERSION=1.10", nil, nil, true},
+		{"go-ethereum:GO_VERSION", nil, nil, true},
+		{"go-ethereum:=1.10", nil, nil, true},
+		{"go-(ethereum:A=1", nil, nil, true},
+	}
+	for _, tt := range tests {
+		var args buildArgList
+		err := args.Set(tt.value)
+		if (err != nil) != tt.fail {
+			t.Errorf("%q: failure mismatch: have %v, want failure %v", tt.value, err, tt.fail)
+			continue
+		}
+		if tt.fail {
+			continue
+		}
+		if len(args) != len(tt.args) {
+			t.Errorf("%q: arg count mismatch: have %d, want %d", tt.value, len(args), len(tt.args))
+			continue
+		}
+		for i, arg := range args {
+			if arg.pattern.String() != tt.patterns[i] || arg.arg != tt.args[i] {
+				t.Errorf("%q: arg %d mismatch: have %s:%v, want %s:%v", tt.value, i, arg.pattern, arg.arg, tt.patterns[i], tt.args[i])
+			}
+		}
+	}
+}
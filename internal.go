@@ -1,17 +1,62 @@
 package main
 
 import (
-	"errors"
+	"fmt"
 	"os"
-	"os/signal"
+	"path/filepath"
 
 	"github.com/fsouza/go-dockerclient"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
-// makeGenesisDAG runs the ethash DAG generator to ensure that the genesis epochs
-// DAG is created prior to it being needed by simulations.
-func makeGenesisDAG(daemon *docker.Client, cacher *buildCacher) error {
+// makeGenesisDAG ensures that the DAGs of the given genesis epochs are created
+// prior to them being needed by simulations. If a DAG cache was requested, a still
+// intact DAG from a previous run is reused, otherwise the generator is run and the
+// cache recorded.
+func makeGenesisDAG(daemon *dockerClient, cacher *buildCacher, epochs []int) error {
+	if *dagCache == "" {
+		return generateGenesisDAGs(daemon, cacher, epochs)
+	}
+	dir, err := ethashDir()
+	if err != nil {
+		return err
+	}
+	valid, err := validDAGCache(dir, epochs)
+	if err != nil {
+		log15.Error("failed to validate DAG cache", "error", err)
+		return err
+	}
+	if valid {
+		log15.Info("reusing cached genesis DAG", "cache", dir, "epochs", epochs)
+		return nil
+	}
+	log15.Info("DAG cache missing or invalid, regenerating", "cache", dir)
+	if err := os.Remove(filepath.Join(dir, dagManifestFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := generateGenesisDAGs(daemon, cacher, epochs); err != nil {
+		return err
+	}
+	if err := writeDAGManifest(dir, epochs); err != nil {
+		log15.Error("failed to record DAG cache", "error", err)
+		return err
+	}
+	return nil
+}
+
+// generateGenesisDAGs runs the ethash DAG generator for each of the given epochs.
+func generateGenesisDAGs(daemon *dockerClient, cacher *buildCacher, epochs []int) error {
+	for _, epoch := range epochs {
+		if err := generateGenesisDAG(daemon, cacher, epoch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateGenesisDAG runs the ethash DAG generator to create the DAG of a single
+// genesis epoch.
+func generateGenesisDAG(daemon *dockerClient, cacher *buildCacher, epoch int) error {
 	// Build the image for the DAG generator
 	log15.Info("creating ethash container")
 
@@ -20,7 +65,7 @@ func makeGenesisDAG(daemon *docker.Client, cacher *buildCacher) error {
 		return err
 	}
 	// Create the ethash container container and make sure it's deleted afterwards
-	ethash, err := createEthashContainer(daemon, image)
+	ethash, err := createEthashContainer(daemon, image, epoch)
 	if err != nil {
 		log15.Error("failed to create ethash container", "error", err)
 		return err
@@ -35,33 +80,27 @@ func makeGenesisDAG(daemon *docker.Client, cacher *buildCacher) error {
 		}
 	}()
 	// Start generating the genesis ethash DAG
-	log15.Info("generating genesis DAG")
+	log15.Info("generating genesis DAG", "epoch", epoch)
 
-	waiter, err := runContainer(daemon, ethash.ID, log15.Root(), "", true)
+	waiter, err := runContainer(daemon, ethash.ID, log15.Root(), "", true, nil)
 	if err != nil {
 		log15.Error("failed to execute ethash", "error", err)
 		return err
 	}
-	// Register an interrupt handler to cleanly tear ethash down
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-
-	errc := make(chan error, 1)
-	go func() {
-		<-interrupt
-		errc <- errors.New("interrupted")
-		err := daemon.StopContainer(ethash.ID, 0)
-		if err != nil {
-			log15.Error("failed to stop ethash", "error", err)
-		}
-	}()
-	// Wait for container termination and return
+	// Wait for container termination, bailing out if hive itself was terminated
 	waiter.Wait()
 
-	select {
-	case err := <-errc:
+	if terminated() {
+		return errTerminated
+	}
+	// Make sure the generator succeeded, partial DAGs must not be cached
+	c, err := daemon.InspectContainer(ethash.ID)
+	if err != nil {
+		log15.Error("failed to inspect ethash", "error", err)
 		return err
-	default:
-		return nil
 	}
+	if c.State.ExitCode != 0 {
+		return fmt.Errorf("ethash generator exited with code %d", c.State.ExitCode)
+	}
+	return nil
 }
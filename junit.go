@@ -0,0 +1,164 @@
+// This file contains the utility methods for exporting the validation and
+// simulation results as JUnit XML, the format understood by most CI dashboards.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// junitReport is the root element of a JUnit XML report.
+type junitReport struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+// junitSuite is the group of all the tests ran against a single client.
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`     // Client the tests were run against
+	Tests    int         `xml:"tests,attr"`    // Number of tests within the suite
+	Failures int         `xml:"failures,attr"` // Number of tests that ran to completion, but failed
+	Errors   int         `xml:"errors,attr"`   // Number of tests that could not be run due to a hive failure
+	Skipped  int         `xml:"skipped,attr"`  // Number of tests deliberately not run
+	Time     string      `xml:"time,attr"`     // Total duration of the tests in seconds
+	Cases    []junitCase `xml:"testcase"`
+
+	elapsed time.Duration // Total duration of the tests, formatted into Time once all are added
+}
+
+// junitCase is a single validation or simulation ran against a client.
+type junitCase struct {
+	Name      string        `xml:"name,attr"`      // Name of the validator or simulator
+	Classname string        `xml:"classname,attr"` // Kind of the test (validator or simulator)
+	Time      string        `xml:"time,attr"`      // Duration of the test in seconds
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+	Skipped   *junitProblem `xml:"skipped,omitempty"`
+}
+
+// junitProblem is the failure, error or skip details of a test case.
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// writeJUnitReport converts the validation and simulation results into JUnit XML,
+// grouping the tests into one suite per client, and writes them into path.
+func writeJUnitReport(path string, results *resultSet) error {
+	suites := make(map[string]*junitSuite)
+	add := func(client string, test junitCase, elapsed time.Duration) {
+		suite, ok := suites[client]
+		if !ok {
+			suite = &junitSuite{Name: client}
+			suites[client] = suite
+		}
+		suite.Tests++
+		suite.elapsed += elapsed
+		if test.Failure != nil {
+			suite.Failures++
+		}
+		if test.Error != nil {
+			suite.Errors++
+		}
+		if test.Skipped != nil {
+			suite.Skipped++
+		}
+		suite.Cases = append(suite.Cases, test)
+	}
+	for client, tests := range results.Validations {
+		for validator, result := range tests {
+			test := junitCase{Name: validator, Classname: "validator", Time: junitSeconds(result.End.Sub(result.Start))}
+			switch {
+			case result.Skipped:
+				test.Skipped = &junitProblem{Message: "skipped via -test-skip"}
+			case result.Error != nil:
+				test.Error = &junitProblem{Message: result.Error.Error()}
+			case !result.Success:
+				test.Failure = &junitProblem{Message: "validation failed", Body: validationFailures(result)}
+			}
+			add(client, test, result.End.Sub(result.Start))
+		}
+	}
+	for client, tests := range results.Simulations {
+		for simulator, result := range tests {
+			test := junitCase{Name: simulator, Classname: "simulator", Time: junitSeconds(result.End.Sub(result.Start))}
+			switch {
+			case result.Skipped:
+				test.Skipped = &junitProblem{Message: "skipped via -sim-skip"}
+			case result.NotRun:
+				test.Skipped = &junitProblem{Message: "not run by the simulator"}
+			case result.Error != nil:
+				test.Error = &junitProblem{Message: result.Error.Error()}
+			case !result.Success:
+				test.Failure = &junitProblem{Message: "simulation failed", Body: simulationFailures(result)}
+			}
+			add(client, test, result.End.Sub(result.Start))
+		}
+	}
+	// Sort everything to keep the report deterministic
+	report := junitReport{Suites: make([]junitSuite, 0, len(suites))}
+	for _, suite := range suites {
+		sort.Slice(suite.Cases, func(i, j int) bool {
+			if suite.Cases[i].Classname != suite.Cases[j].Classname {
+				return suite.Cases[i].Classname > suite.Cases[j].Classname
+			}
+			return suite.Cases[i].Name < suite.Cases[j].Name
+		})
+		suite.Time = junitSeconds(suite.elapsed)
+		report.Suites = append(report.Suites, *suite)
+	}
+	sort.Slice(report.Suites, func(i, j int) bool { return report.Suites[i].Name < report.Suites[j].Name })
+
+	out, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append([]byte(xml.Header), out...), 0644)
+}
+
+// junitSeconds formats a test duration as the fractional seconds JUnit expects.
+func junitSeconds(elapsed time.Duration) string {
+	return fmt.Sprintf("%.3f", elapsed.Seconds())
+}
+
+// validationFailures lists the reasons a validation failed, beyond the validator
+// itself exiting with a failure code.
+func validationFailures(result *validationResult) string {
+	var reasons []string
+	for _, check := range result.Logs {
+		if !check.Success {
+			reasons = append(reasons, fmt.Sprintf("%s log pattern %q not satisfied", check.Kind, check.Pattern))
+		}
+	}
+	if d := result.Divergence; d != nil {
+		reasons = append(reasons, fmt.Sprintf("chain diverged at block %d: %s expected %s, got %s", d.Block, d.Field, d.Expected, d.Actual))
+	}
+	for _, diff := range result.SchemaDiffs {
+		reasons = append(reasons, fmt.Sprintf("%s response %s: expected %s, got %s", diff.Method, diff.Path, diff.Expected, diff.Actual))
+	}
+	for _, mismatch := range result.Trace {
+		reasons = append(reasons, fmt.Sprintf("trace #%d %s response %s: expected %s, got %s", mismatch.Index, mismatch.Method, mismatch.Path, mismatch.Expected, mismatch.Actual))
+	}
+	return strings.Join(reasons, "\n")
+}
+
+// simulationFailures lists the failed subresults of a simulation.
+func simulationFailures(result *simulationResult) string {
+	var reasons []string
+	for _, sub := range result.Subresults {
+		if !sub.Success {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", sub.Name, sub.Error))
+		}
+	}
+	return strings.Join(reasons, "\n")
+}
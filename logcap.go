@@ -0,0 +1,103 @@
+// This file contains the utility methods for capping the size of the container
+// logs captured by hive, protecting the host from runaway clients.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// truncatedLogs is the set of captured log files that exceeded -log-max-bytes and
+// had their heads dropped.
+var (
+	truncatedLogs = make(map[string]bool)
+	truncatedLock sync.Mutex
+)
+
+// cappedLog is a container log file that retains only the last limit bytes of
+// the output written into it. To avoid rewriting the file on every write, the log
+// is allowed to grow to twice the limit before being compacted back.
+type cappedLog struct {
+	file  *os.File // Log file opened for both reading and writing
+	path  string   // Path of the log file, to report truncation with
+	limit int64    // Maximum number of bytes to retain
+	size  int64    // Number of bytes currently in the file
+	lock  sync.Mutex
+}
+
+// newCappedLog wraps a freshly truncated log file, capping it to limit bytes.
+func newCappedLog(file *os.File, path string, limit int64) *cappedLog {
+	return &cappedLog{file: file, path: path, limit: limit}
+}
+
+// Write implements io.Writer, appending to the log and compacting it if it grew
+// too large.
+func (l *cappedLog) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	if err == nil && l.size > 2*l.limit {
+		err = l.compact()
+	}
+	return n, err
+}
+
+// Close implements io.Closer, trimming the log to its limit and closing it.
+func (l *cappedLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.size > l.limit {
+		if err := l.compact(); err != nil {
+			l.file.Close()
+			return err
+		}
+	}
+	return l.file.Close()
+}
+
+// compact drops everything from the log file but its last limit bytes.
+func (l *cappedLog) compact() error {
+	truncatedLock.Lock()
+	truncatedLogs[l.path] = true
+	truncatedLock.Unlock()
+
+	tail := make([]byte, l.limit)
+	if _, err := l.file.ReadAt(tail, l.size-l.limit); err != nil {
+		return err
+	}
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.file.WriteAt(tail, 0); err != nil {
+		return err
+	}
+	if _, err := l.file.Seek(l.limit, io.SeekStart); err != nil {
+		return err
+	}
+	l.size = l.limit
+	return nil
+}
+
+// truncatedLogsIn lists the captured log files within a folder (or the file at
+// the path itself) that were truncated due to exceeding -log-max-bytes.
+func truncatedLogsIn(path string) []string {
+	truncatedLock.Lock()
+	defer truncatedLock.Unlock()
+
+	var logs []string
+	for log := range truncatedLogs {
+		if log == path || strings.HasPrefix(log, path+string(filepath.Separator)) {
+			logs = append(logs, log)
+		}
+	}
+	sort.Strings(logs)
+	return logs
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Tests that capped logs retain exactly the tail of everything written into them,
+// across compactions, and report the truncation only if something was dropped.
+func TestCappedLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hive-logcap-")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		limit  int64 // Maximum number of bytes to retain
+		chunk  int   // Number of bytes written at once
+		writes int   // Number of writes
+	}{
+		{limit: 100, chunk: 10, writes: 5},   // Below the limit, nothing dropped
+		{limit: 100, chunk: 10, writes: 10},  // Exactly at the limit
+		{limit: 100, chunk: 10, writes: 15},  // Above the limit, no compaction yet
+		{limit: 100, chunk: 10, writes: 100}, // Many compactions
+		{limit: 100, chunk: 7, writes: 73},   // Writes straddling the compaction point
+		{limit: 10, chunk: 64, writes: 3},    // Single writes larger than the limit
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("test-%d.log", i))
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatalf("test %d: failed to create log: %v", i, err)
+		}
+		log := newCappedLog(file, path, tt.limit)
+
+		written := new(bytes.Buffer)
+		for w := 0; w < tt.writes; w++ {
+			chunk := make([]byte, tt.chunk)
+			for j := range chunk {
+				chunk[j] = byte('a' + (w*tt.chunk+j)%26)
+			}
+			if _, err := log.Write(chunk); err != nil {
+				t.Fatalf("test %d: failed to write log: %v", i, err)
+			}
+			written.Write(chunk)
+		}
+		if err := log.Close(); err != nil {
+			t.Fatalf("test %d: failed to close log: %v", i, err)
+		}
+		have, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("test %d: failed to read log: %v", i, err)
+		}
+		want := written.Bytes()
+		if int64(len(want)) > tt.limit {
+			want = want[int64(len(want))-tt.limit:]
+		}
+		if !bytes.Equal(have, want) {
+			t.Errorf("test %d: log content mismatch: have %q, want %q", i, have, want)
+		}
+		truncated := len(truncatedLogsIn(path)) > 0
+		if dropped := int64(written.Len()) > tt.limit; truncated != dropped {
+			t.Errorf("test %d: truncation report mismatch: have %v, want %v", i, truncated, dropped)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// This file contains the utility methods for exporting the client logs of failed
+// tests into a single, predictable folder for later inspection.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// exportTestLogs copies the client logs captured during a test into -logdir as
+// <logdir>/<client>/<test>.log, concatenating them if the test ran multiple
+// client containers. Logs are only exported for failed tests unless -logall was
+// requested. The path of the exported file is returned, or an empty string if
+// nothing was exported.
+func exportTestLogs(client, test string, success bool, sources []string) (string, error) {
+	if *logDir == "" || (success && !*logAll) || len(sources) == 0 {
+		return "", nil
+	}
+	sort.Strings(sources)
+
+	path := filepath.Join(*logDir, strings.Replace(client, string(filepath.Separator), "_", -1), strings.Replace(test, string(filepath.Separator), "_", -1)+".log")
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return "", err
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	for _, source := range sources {
+		if len(sources) > 1 {
+			fmt.Fprintf(out, "==> %s <==\n", filepath.Base(source))
+		}
+		in, err := os.Open(source)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
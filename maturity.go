@@ -0,0 +1,60 @@
+// This file contains the utility methods for selecting and treating clients based
+// on their declared maturity level.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Maturity levels a client may declare in its metadata.
+const (
+	maturityStable       = "stable"       // Production ready, failures break the run
+	maturityBeta         = "beta"         // Feature complete, failures break the run
+	maturityExperimental = "experimental" // Bleeding edge, failures are informational only
+)
+
+// maturityLevels is the set of valid client maturity levels.
+var maturityLevels = map[string]bool{
+	maturityStable:       true,
+	maturityBeta:         true,
+	maturityExperimental: true,
+}
+
+// clientMaturity returns the maturity level a client declared in its metadata,
+// defaulting to stable if none was declared or the metadata cannot be loaded.
+func clientMaturity(client string) string {
+	meta, err := loadClientMetadata(client)
+	if err != nil || meta.Maturity == "" {
+		return maturityStable
+	}
+	return meta.Maturity
+}
+
+// maturityPattern narrows a client selection pattern down to the clients whose
+// maturity level is among the ones requested via -client-maturity.
+func maturityPattern(pattern string) (string, error) {
+	allowed := make(map[string]bool)
+	for _, level := range strings.Split(*maturityFlag, ",") {
+		if !maturityLevels[level] {
+			return "", fmt.Errorf("invalid client maturity %q", level)
+		}
+		allowed[level] = true
+	}
+	clients, err := listNestedImages("clients", pattern)
+	if err != nil {
+		return "", err
+	}
+	names := make(map[string]bool)
+	for _, client := range clients {
+		if allowed[clientMaturity(client)] {
+			names[filepath.Join("clients", client)] = true
+		}
+	}
+	if len(names) == 0 {
+		return "^$", nil
+	}
+	return exactPattern(names), nil
+}
@@ -0,0 +1,115 @@
+// This file contains the utility methods for merging partial result files from
+// multiple hive runs (e.g. shards of a test matrix) into a single result set.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// partialResultSet is the generic form of a hive result file, keeping the actual
+// results opaque so they can be merged without needing to understand them.
+type partialResultSet struct {
+	Setup       *globalResult                         `json:"setup,omitempty"`
+	Teardown    *globalResult                         `json:"teardown,omitempty"`
+	Clients     map[string]json.RawMessage            `json:"clients,omitempty"`
+	Validations map[string]map[string]json.RawMessage `json:"validations,omitempty"`
+	Simulations map[string]map[string]json.RawMessage `json:"simulations,omitempty"`
+	Benchmarks  map[string]map[string]json.RawMessage `json:"benchmarks,omitempty"`
+}
+
+// mergeResultFiles loads a batch of partial result files and deep merges them into
+// a single result set, written to output (or stdout if empty). The same client or
+// client/test entry appearing in multiple files is only accepted if the entries
+// are identical, otherwise the merge is aborted with a conflict error.
+func mergeResultFiles(files []string, output string) error {
+	merged := &partialResultSet{
+		Clients:     make(map[string]json.RawMessage),
+		Validations: make(map[string]map[string]json.RawMessage),
+		Simulations: make(map[string]map[string]json.RawMessage),
+		Benchmarks:  make(map[string]map[string]json.RawMessage),
+	}
+	for _, file := range files {
+		blob, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var partial partialResultSet
+		if err := json.Unmarshal(blob, &partial); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		// Keep the earliest global setup and the latest global teardown
+		if partial.Setup != nil && (merged.Setup == nil || partial.Setup.Start.Before(merged.Setup.Start)) {
+			merged.Setup = partial.Setup
+		}
+		if partial.Teardown != nil && (merged.Teardown == nil || partial.Teardown.End.After(merged.Teardown.End)) {
+			merged.Teardown = partial.Teardown
+		}
+		// Merge all the client and test entries, failing on conflicts
+		for client, version := range partial.Clients {
+			if err := mergeResultEntry(merged.Clients, client, version); err != nil {
+				return fmt.Errorf("%s: client %s: %v", file, client, err)
+			}
+		}
+		if err := mergeResultCategory(merged.Validations, partial.Validations); err != nil {
+			return fmt.Errorf("%s: validation %v", file, err)
+		}
+		if err := mergeResultCategory(merged.Simulations, partial.Simulations); err != nil {
+			return fmt.Errorf("%s: simulation %v", file, err)
+		}
+		if err := mergeResultCategory(merged.Benchmarks, partial.Benchmarks); err != nil {
+			return fmt.Errorf("%s: benchmark %v", file, err)
+		}
+	}
+	out, err := json.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		fmt.Println(string(out))
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(output), os.ModePerm); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(output, out, 0644)
+}
+
+// mergeResultCategory merges all the client/test results of a single category
+// from a partial result set into the merged one.
+func mergeResultCategory(dest, src map[string]map[string]json.RawMessage) error {
+	for client, tests := range src {
+		if _, ok := dest[client]; !ok {
+			dest[client] = make(map[string]json.RawMessage)
+		}
+		for test, result := range tests {
+			if err := mergeResultEntry(dest[client], test, result); err != nil {
+				return fmt.Errorf("%s/%s: %v", client, test, err)
+			}
+		}
+	}
+	return nil
+}
+
+// mergeResultEntry inserts a single result entry into a merged set, accepting
+// duplicates only if they are identical to the already present one.
+func mergeResultEntry(dest map[string]json.RawMessage, key string, entry json.RawMessage) error {
+	compact := new(bytes.Buffer)
+	if err := json.Compact(compact, entry); err != nil {
+		return err
+	}
+	if old, ok := dest[key]; ok {
+		if !bytes.Equal(old, compact.Bytes()) {
+			return errors.New("conflicting entries")
+		}
+		return nil
+	}
+	dest[key] = json.RawMessage(compact.Bytes())
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Tests that single result entries are merged, accepting identical duplicates
+// (regardless of formatting) and rejecting conflicting ones.
+func TestMergeResultEntry(t *testing.T) {
+	tests := []struct {
+		present string // Entry already in the merged set, empty for none
+		entry   string // Entry to merge in
+		want    string // Expected merged entry, compacted
+		fail    bool   // Whether the merge should fail
+	}{
+		{"", `{"success": true}`, `{"success":true}`, false},
+		{`{"success":true}`, `{ "success" : true }`, `{"success":true}`, false},
+		{`{"success":true}`, `{"success":false}`, `{"success":true}`, true},
+		{`{"success":true}`, `{"success":true,"error":"x"}`, `{"success":true}`, true},
+		{"", `{"success":`, "", true},
+	}
+	for i, tt := range tests {
+		dest := make(map[string]json.RawMessage)
+		if tt.present != "" {
+			dest["key"] = json.RawMessage(tt.present)
+		}
+		err := mergeResultEntry(dest, "key", json.RawMessage(tt.entry))
+		if (err != nil) != tt.fail {
+			t.Errorf("test %d: failure mismatch: have %v, want failure %v", i, err, tt.fail)
+		}
+		if have := string(dest["key"]); have != tt.want {
+			t.Errorf("test %d: merged entry mismatch: have %s, want %s", i, have, tt.want)
+		}
+	}
+}
+
+// Tests that merging a category reports the conflicting client/test pair and
+// keeps the disjoint entries of both sides.
+func TestMergeResultCategory(t *testing.T) {
+	dest := map[string]map[string]json.RawMessage{
+		"geth": {"a": json.RawMessage(`{"success":true}`)},
+	}
+	src := map[string]map[string]json.RawMessage{
+		"geth":   {"b": json.RawMessage(`{"success":true}`)},
+		"parity": {"a": json.RawMessage(`{"success":false}`)},
+	}
+	if err := mergeResultCategory(dest, src); err != nil {
+		t.Fatalf("failed to merge disjoint results: %v", err)
+	}
+	if len(dest["geth"]) != 2 || len(dest["parity"]) != 1 {
+		t.Fatalf("merged results mismatch: have %v", dest)
+	}
+	conflict := map[string]map[string]json.RawMessage{
+		"geth": {"a": json.RawMessage(`{"success":false}`)},
+	}
+	err := mergeResultCategory(dest, conflict)
+	if err == nil || !strings.Contains(err.Error(), "geth/a") {
+		t.Fatalf("conflict error mismatch: have %v, want geth/a conflict", err)
+	}
+}
+
+// Tests that whole result files are merged, keeping the earliest global setup and
+// rejecting files conflicting with each other.
+func TestMergeResultFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hive-merge-")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"shard1.json":   `{"setup":{"start":"2018-01-02T00:00:00Z"},"clients":{"geth":{"version":"1"}},"validations":{"geth":{"a":{"success":true}}}}`,
+		"shard2.json":   `{"setup":{"start":"2018-01-01T00:00:00Z"},"clients":{"geth":{"version":"1"}},"validations":{"geth":{"b":{"success":false}}}}`,
+		"conflict.json": `{"clients":{"geth":{"version":"2"}}}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	output := filepath.Join(dir, "merged.json")
+	if err := mergeResultFiles([]string{filepath.Join(dir, "shard1.json"), filepath.Join(dir, "shard2.json")}, output); err != nil {
+		t.Fatalf("failed to merge shards: %v", err)
+	}
+	blob, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("failed to read merged results: %v", err)
+	}
+	var merged partialResultSet
+	if err := json.Unmarshal(blob, &merged); err != nil {
+		t.Fatalf("failed to parse merged results: %v", err)
+	}
+	if len(merged.Validations["geth"]) != 2 {
+		t.Errorf("merged validations mismatch: have %v, want a and b", merged.Validations["geth"])
+	}
+	if merged.Setup == nil || merged.Setup.Start.Day() != 1 {
+		t.Errorf("merged setup mismatch: have %v, want the earliest", merged.Setup)
+	}
+	if err := mergeResultFiles([]string{filepath.Join(dir, "shard1.json"), filepath.Join(dir, "conflict.json")}, output); err == nil {
+		t.Errorf("conflicting client versions merged")
+	}
+}
@@ -0,0 +1,210 @@
+// This file contains the utility methods for loading the optional hive specific
+// metadata shipped alongside the client and tester image definitions.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// hiveMetadataFile is the name of the optional file within an image definition
+// folder holding hive specific configurations.
+const hiveMetadataFile = "hive.json"
+
+// clientMetadata is the optional hive specific configuration of a client.
+type clientMetadata struct {
+	TimeoutMultiplier float64  `json:"timeoutMultiplier,omitempty"` // Scaler for all the per-test timeouts of the client
+	SyncModes         []string `json:"syncModes,omitempty"`         // Sync modes the client supports (empty = all)
+	Maturity          string   `json:"maturity,omitempty"`          // Maturity level of the client (default stable)
+}
+
+// loadClientMetadata reads the hive metadata of a client from its image definition
+// folder. Clients without any metadata get the defaults.
+func loadClientMetadata(client string) (*clientMetadata, error) {
+	meta := new(clientMetadata)
+
+	blob, err := ioutil.ReadFile(filepath.Join("clients", client, hiveMetadataFile))
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(blob, meta); err != nil {
+		return nil, fmt.Errorf("invalid %s metadata: %v", client, err)
+	}
+	if meta.TimeoutMultiplier < 0 {
+		return nil, fmt.Errorf("invalid %s metadata: negative timeout multiplier", client)
+	}
+	if meta.Maturity != "" && !maturityLevels[meta.Maturity] {
+		return nil, fmt.Errorf("invalid %s metadata: unknown maturity %q", client, meta.Maturity)
+	}
+	return meta, nil
+}
+
+// timeout scales a per-test timeout by the client's multiplier, if any.
+func (m *clientMetadata) timeout(base time.Duration) time.Duration {
+	if m.TimeoutMultiplier == 0 {
+		return base
+	}
+	return time.Duration(float64(base) * m.TimeoutMultiplier)
+}
+
+// supportsSyncMode checks whether the client can be run in the given sync mode.
+// Clients not declaring their sync modes are assumed to support all of them.
+func (m *clientMetadata) supportsSyncMode(mode string) bool {
+	if len(m.SyncModes) == 0 {
+		return true
+	}
+	for _, supported := range m.SyncModes {
+		if supported == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// testMetadata is the optional hive specific configuration of a tester (i.e. a
+// validator, simulator or benchmarker).
+type testMetadata struct {
+	Logs      *logAssertions  `json:"logs,omitempty"`      // Patterns to check the client logs against
+	Consensus bool            `json:"consensus,omitempty"` // Whether to cross check the imported chains of all clients
+	Schema    *rpcSchemaCheck `json:"rpcSchema,omitempty"` // RPC calls to compare the response structures of across clients
+	Trace     *rpcTraceCheck  `json:"rpcTrace,omitempty"`  // Recorded RPC traffic to replay against the clients
+	Timeout   string          `json:"timeout,omitempty"`   // Time a test's containers may run for (e.g. 40m, default -dockertimeout)
+	Genesis   string          `json:"genesis,omitempty"`   // Genesis file (relative to the test) to initialize simulation clients with
+
+	timeout time.Duration // Parsed Timeout, zero if the test declared none
+	genesis *genesisSpec  // Validated Genesis, nil if the test declared none
+}
+
+// logAssertions is a set of regexp patterns the logs of a client container must
+// or must not contain for a test to pass.
+type logAssertions struct {
+	Required  []string `json:"required,omitempty"`  // Patterns that must appear in the client logs
+	Forbidden []string `json:"forbidden,omitempty"` // Patterns that must not appear in the client logs
+
+	required  []*regexp.Regexp
+	forbidden []*regexp.Regexp
+}
+
+// logAssertionResult is the outcome of checking a single log pattern.
+type logAssertionResult struct {
+	Pattern string `json:"pattern"`         // Regexp pattern checked against the logs
+	Kind    string `json:"kind"`            // Whether the pattern was required or forbidden
+	Success bool   `json:"success"`         // Whether the assertion held
+	Match   string `json:"match,omitempty"` // First log line matching the pattern, if any
+}
+
+// loadTestMetadata reads the hive metadata of a tester from its image definition
+// folder within root. Testers without any metadata get the defaults.
+func loadTestMetadata(root string, test string) (*testMetadata, error) {
+	meta := new(testMetadata)
+
+	blob, err := ioutil.ReadFile(filepath.Join(root, test, hiveMetadataFile))
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(blob, meta); err != nil {
+		return nil, fmt.Errorf("invalid %s metadata: %v", test, err)
+	}
+	if meta.Logs != nil {
+		for _, pattern := range meta.Logs.Required {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s required log pattern: %v", test, err)
+			}
+			meta.Logs.required = append(meta.Logs.required, re)
+		}
+		for _, pattern := range meta.Logs.Forbidden {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s forbidden log pattern: %v", test, err)
+			}
+			meta.Logs.forbidden = append(meta.Logs.forbidden, re)
+		}
+	}
+	if meta.Timeout != "" {
+		if meta.timeout, err = time.ParseDuration(meta.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid %s timeout: %v", test, err)
+		}
+		if meta.timeout <= 0 {
+			return nil, fmt.Errorf("invalid %s timeout: non-positive duration", test)
+		}
+	}
+	if meta.Trace != nil {
+		if err := meta.Trace.load(filepath.Join(root, test)); err != nil {
+			return nil, fmt.Errorf("invalid %s RPC trace: %v", test, err)
+		}
+	}
+	if meta.Genesis != "" {
+		if meta.genesis, err = loadGenesis(filepath.Join(root, test, meta.Genesis)); err != nil {
+			return nil, fmt.Errorf("invalid %s metadata: %v", test, err)
+		}
+	}
+	return meta, nil
+}
+
+// testTimeout returns the time the containers of a test may run for, falling back
+// to the global -dockertimeout if the test declared none. Validators don't use the
+// fallback, they are only bounded by an explicit timeout.
+func (m *testMetadata) testTimeout() time.Duration {
+	if m.timeout == 0 {
+		return dockerTimeoutDuration
+	}
+	return m.timeout
+}
+
+// testGenesis returns the genesis to initialize the clients of a test with, which
+// is the global -genesis if requested, or the test's own otherwise. Nil means the
+// clients are initialized from the tester image.
+func (m *testMetadata) testGenesis() *genesisSpec {
+	if genesisOverride != nil {
+		return genesisOverride
+	}
+	return m.genesis
+}
+
+// check runs all the log assertions against a captured log, returning whether
+// all of them held, along with the individual outcomes.
+func (a *logAssertions) check(log []byte) (bool, []logAssertionResult) {
+	var (
+		success = true
+		results []logAssertionResult
+	)
+	for _, re := range a.required {
+		line, found := matchedLine(log, re)
+		results = append(results, logAssertionResult{Pattern: re.String(), Kind: "required", Success: found, Match: line})
+		success = success && found
+	}
+	for _, re := range a.forbidden {
+		line, found := matchedLine(log, re)
+		results = append(results, logAssertionResult{Pattern: re.String(), Kind: "forbidden", Success: !found, Match: line})
+		success = success && !found
+	}
+	return success, results
+}
+
+// matchedLine returns the first full log line matching a pattern, if any.
+func matchedLine(log []byte, re *regexp.Regexp) (string, bool) {
+	loc := re.FindIndex(log)
+	if loc == nil {
+		return "", false
+	}
+	start := bytes.LastIndexByte(log[:loc[0]], '\n') + 1
+	end := bytes.IndexByte(log[loc[0]:], '\n')
+	if end < 0 {
+		return string(log[start:]), true
+	}
+	return string(log[start : loc[0]+end]), true
+}
@@ -0,0 +1,218 @@
+// This file contains the utility methods for exposing the progress of a hive run
+// as Prometheus metrics, allowing long running invocations to be charted.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// metricsLock protects all the metrics from concurrent updates and scrapes.
+var metricsLock sync.Mutex
+
+// durationBuckets are the upper bounds (in seconds) of the duration histograms,
+// spanning from quick smoke tests to multi-hour syncs.
+var durationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600, 7200}
+
+var (
+	clientsBuiltMetric = &counterVec{name: "hive_clients_built_total", help: "Number of client images built"}
+	testsMetric        = &counterVec{name: "hive_tests_total", help: "Number of tests finished, by category and result"}
+
+	buildDurationMetric = &histogramVec{name: "hive_image_build_duration_seconds", help: "Time spent building docker images, by image kind", buckets: durationBuckets}
+	testDurationMetric  = &histogramVec{name: "hive_test_duration_seconds", help: "Time spent running the containers of a test, by category", buckets: durationBuckets}
+
+	dockerCallsMetric     = &counterVec{name: "hive_docker_api_calls_total", help: "Number of Docker API calls issued, by result"}
+	dockerThrottledMetric = &counterVec{name: "hive_docker_api_throttled_seconds_total", help: "Time Docker API calls spent waiting for the rate limiter"}
+	dockerRateMetric      = &gauge{name: "hive_docker_api_rate_limit", help: "Maximum number of Docker API calls per second (0 = unlimited)"}
+)
+
+// counterVec is a Prometheus counter partitioned by label values.
+type counterVec struct {
+	name   string
+	help   string
+	values map[string]float64 // Counter values keyed by formatted label set
+}
+
+// gauge is a single, unpartitioned Prometheus gauge.
+type gauge struct {
+	name  string
+	help  string
+	value float64
+}
+
+// histogramVec is a Prometheus histogram partitioned by label values.
+type histogramVec struct {
+	name    string
+	help    string
+	buckets []float64
+	series  map[string]*histogram // Histograms keyed by formatted label set
+}
+
+// histogram is a single Prometheus histogram series.
+type histogram struct {
+	counts []uint64 // Number of observations per bucket (not cumulative)
+	sum    float64  // Sum of all the observed values
+	count  uint64   // Number of observations
+}
+
+// metricLabels formats a list of label name/value pairs into Prometheus form.
+func metricLabels(pairs ...string) string {
+	labels := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf("%s=%q", pairs[i], pairs[i+1]))
+	}
+	return strings.Join(labels, ",")
+}
+
+// inc increments the counter of a label set.
+func (c *counterVec) inc(labels string) {
+	c.add(labels, 1)
+}
+
+// add increases the counter of a label set by the given amount.
+func (c *counterVec) add(labels string, value float64) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	if c.values == nil {
+		c.values = make(map[string]float64)
+	}
+	c.values[labels] += value
+}
+
+// set updates the current value of the gauge.
+func (g *gauge) set(value float64) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	g.value = value
+}
+
+// observe records a single value into the histogram of a label set.
+func (h *histogramVec) observe(labels string, value float64) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	if h.series == nil {
+		h.series = make(map[string]*histogram)
+	}
+	series, ok := h.series[labels]
+	if !ok {
+		series = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[labels] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+			break
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+// recordTest accounts a finished test in the outcome counter and the runtime
+// histogram of its category.
+func recordTest(category string, success bool, elapsed time.Duration) {
+	result := "failed"
+	if success {
+		result = "passed"
+	}
+	testsMetric.inc(metricLabels("category", category, "result", result))
+	testDurationMetric.observe(metricLabels("category", category), elapsed.Seconds())
+}
+
+// writeMetrics writes all the metrics in the Prometheus text exposition format.
+func writeMetrics(w io.Writer) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	for _, c := range []*counterVec{clientsBuiltMetric, testsMetric, dockerCallsMetric, dockerThrottledMetric} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, labels := range sortedKeys(c.values) {
+			fmt.Fprintf(w, "%s%s %v\n", c.name, braced(labels), c.values[labels])
+		}
+	}
+	for _, g := range []*gauge{dockerRateMetric} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", g.name, g.help, g.name, g.name, g.value)
+	}
+	for _, h := range []*histogramVec{buildDurationMetric, testDurationMetric} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+		labelsets := make([]string, 0, len(h.series))
+		for labels := range h.series {
+			labelsets = append(labelsets, labels)
+		}
+		sort.Strings(labelsets)
+
+		for _, labels := range labelsets {
+			series := h.series[labels]
+
+			var cumulative uint64
+			for i, bound := range h.buckets {
+				cumulative += series.counts[i]
+				fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, braced(labels, metricLabels("le", fmt.Sprint(bound))), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, braced(labels, metricLabels("le", "+Inf")), series.count)
+			fmt.Fprintf(w, "%s_sum%s %v\n", h.name, braced(labels), series.sum)
+			fmt.Fprintf(w, "%s_count%s %d\n", h.name, braced(labels), series.count)
+		}
+	}
+}
+
+// sortedKeys returns the label sets of a counter in a deterministic order.
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// braced joins a number of formatted label sets and wraps them in braces, or
+// returns an empty string if there are no labels at all.
+func braced(labelsets ...string) string {
+	var labels []string
+	for _, set := range labelsets {
+		if set != "" {
+			labels = append(labels, set)
+		}
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// startMetricsServer starts an HTTP server exposing the metrics on /metrics. The
+// returned closer shuts the server down.
+func startMetricsServer(addr string) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+
+	log15.Info("metrics server started", "addr", listener.Addr())
+	return func() {
+		if err := server.Close(); err != nil {
+			log15.Error("failed to stop metrics server", "error", err)
+		}
+	}, nil
+}
@@ -0,0 +1,48 @@
+// This file contains the utility methods for running multiple client test
+// workloads concurrently, bounded by the -parallel flag.
+
+package main
+
+import "sync"
+
+// runParallel executes a batch of jobs, running at most n of them concurrently.
+// Once a job fails no new ones are started, and the first failure is returned
+// after all the already running ones finished. With n = 1 the jobs are run one
+// after the other, in order.
+func runParallel(n int, jobs []func() error) error {
+	if n < 1 {
+		n = 1
+	}
+	var (
+		pend  sync.WaitGroup
+		slots = make(chan struct{}, n)
+		lock  sync.Mutex
+		fail  error
+	)
+	for _, job := range jobs {
+		slots <- struct{}{}
+
+		lock.Lock()
+		failed := fail != nil
+		lock.Unlock()
+		if failed {
+			break
+		}
+		pend.Add(1)
+		go func(job func() error) {
+			defer func() {
+				<-slots
+				pend.Done()
+			}()
+			if err := job(); err != nil {
+				lock.Lock()
+				if fail == nil {
+					fail = err
+				}
+				lock.Unlock()
+			}
+		}(job)
+	}
+	pend.Wait()
+	return fail
+}
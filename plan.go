@@ -0,0 +1,245 @@
+// This file contains the utility methods for resolving the client and test
+// patterns of a run into an explicit test plan, which can be reviewed, saved and
+// later executed verbatim.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// testPlanVersion is the version of the test plan format, bumped whenever a
+// change is made that older hive versions would not interpret correctly.
+const testPlanVersion = 1
+
+// testPlan is a fully resolved list of client/test combinations to run.
+type testPlan struct {
+	Version int             `json:"version"` // Format version of the plan
+	Entries []testPlanEntry `json:"entries"` // Client/test combinations to run
+}
+
+// testPlanEntry is a single client/test combination of a test plan. Simulators
+// are run against all their clients at once, so their entries are only filtered
+// by test, not by client.
+type testPlanEntry struct {
+	Category string `json:"category"` // Test category (validator, simulator or benchmarker)
+	Test     string `json:"test"`     // Name of the test image definition folder
+	Client   string `json:"client"`   // Name of the client image definition folder
+}
+
+// plan is the test plan loaded via the -plan flag, nil if none was requested.
+var plan *testPlan
+
+// testMatrix is the resolved selection of a dry run: all the clients that would
+// be built and all the client/test combinations that would run.
+type testMatrix struct {
+	Clients []string        `json:"clients"` // Clients whose images would be built
+	Entries []testPlanEntry `json:"entries"` // Client/test combinations that would run
+}
+
+// testPlanRoots maps the test categories to the folders containing their images.
+var testPlanRoots = map[string]string{
+	"validator":   "validators",
+	"simulator":   "simulators",
+	"benchmarker": "benchmarkers",
+}
+
+// resolveTestPlan expands the client and per-category test patterns into all the
+// client/test combinations they select, honouring any requested skip patterns,
+// shard and previously loaded plan.
+func resolveTestPlan(clientPattern string, testPatterns map[string]string) (*testPlan, error) {
+	clients, err := listClients(clientPattern)
+	if err != nil {
+		return nil, err
+	}
+	plan := &testPlan{Version: testPlanVersion, Entries: []testPlanEntry{}}
+	for category, root := range testPlanRoots {
+		if testPatterns[category] == "" {
+			continue
+		}
+		tests, err := listNestedImages(root, testPatterns[category])
+		if err != nil {
+			return nil, err
+		}
+		if tests, _, err = skipNestedImages(root, tests, skipPatterns()[category]); err != nil {
+			return nil, err
+		}
+		for _, test := range tests {
+			for _, client := range clients {
+				ok := selected(category, test, client)
+				if category == "simulator" {
+					ok = selected(category, test)
+				}
+				if ok {
+					plan.Entries = append(plan.Entries, testPlanEntry{Category: category, Test: test, Client: client})
+				}
+			}
+		}
+	}
+	plan.sort()
+	return plan, nil
+}
+
+// applyTestPlan loads a previously exported test plan and narrows the client and
+// test selections of the run down to exactly the plan's entries.
+func applyTestPlan(path string) error {
+	var err error
+	if plan, err = loadTestPlan(path); err != nil {
+		return err
+	}
+	*smokeFlag = false
+	*clientPattern = plan.clientPattern()
+	*validatorPattern = plan.testPattern("validator")
+	*simulatorPattern = plan.testPattern("simulator")
+	*benchmarkPattern = plan.testPattern("benchmarker")
+	return nil
+}
+
+// dryRunMatrix resolves the clients and tests a run would select, using the same
+// listing and filtering as the real run, and prints them as JSON to stdout.
+func dryRunMatrix() error {
+	// Clone any ad-hoc git client to know its name, since it would be built too
+	if *clientGit != "" {
+		closer, err := cloneGitClient(*clientGit)
+		if err != nil {
+			return err
+		}
+		defer closer()
+	}
+	if *planFile != "" {
+		if err := applyTestPlan(*planFile); err != nil {
+			return err
+		}
+	}
+	clients, err := listClients(*clientPattern)
+	if err != nil {
+		return err
+	}
+	sort.Strings(clients)
+
+	plan, err := resolveTestPlan(*clientPattern, testPatterns())
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(&testMatrix{Clients: clients, Entries: plan.Entries}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// sort orders the entries of the plan by category, test and client, so that the
+// same selection always serializes identically.
+func (p *testPlan) sort() {
+	sort.Slice(p.Entries, func(i, j int) bool {
+		a, b := p.Entries[i], p.Entries[j]
+		if a.Category != b.Category {
+			return a.Category < b.Category
+		}
+		if a.Test != b.Test {
+			return a.Test < b.Test
+		}
+		return a.Client < b.Client
+	})
+}
+
+// writeTestPlan serializes a test plan and writes it to path.
+func writeTestPlan(path string, plan *testPlan) error {
+	out, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, out, 0644)
+}
+
+// loadTestPlan reads a test plan previously written out by writeTestPlan.
+func loadTestPlan(path string) (*testPlan, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plan := new(testPlan)
+	if err := json.Unmarshal(blob, plan); err != nil {
+		return nil, fmt.Errorf("invalid test plan: %v", err)
+	}
+	if plan.Version != testPlanVersion {
+		return nil, fmt.Errorf("unsupported test plan version %d, want %d", plan.Version, testPlanVersion)
+	}
+	for _, entry := range plan.Entries {
+		if _, ok := testPlanRoots[entry.Category]; !ok {
+			return nil, fmt.Errorf("invalid test plan category %q", entry.Category)
+		}
+	}
+	return plan, nil
+}
+
+// clientPattern returns a regexp matching exactly the clients of the plan.
+func (p *testPlan) clientPattern() string {
+	names := make(map[string]bool)
+	for _, entry := range p.Entries {
+		names[filepath.Join("clients", entry.Client)] = true
+	}
+	if len(names) == 0 {
+		return "^$"
+	}
+	return exactPattern(names)
+}
+
+// testPattern returns a regexp matching exactly the tests of the plan within a
+// category, or an empty pattern if the category is not to be run at all.
+func (p *testPlan) testPattern(category string) string {
+	names := make(map[string]bool)
+	for _, entry := range p.Entries {
+		if entry.Category == category {
+			names[filepath.Join(testPlanRoots[category], entry.Test)] = true
+		}
+	}
+	return exactPattern(names)
+}
+
+// contains checks whether a single entry of the test matrix is part of the plan.
+// Entries are identified the same way as for sharding: category and test name,
+// followed by the client name if the category runs client/test pairs. A nil plan
+// contains everything.
+func (p *testPlan) contains(category string, test string, client ...string) bool {
+	if p == nil {
+		return true
+	}
+	for _, entry := range p.Entries {
+		if entry.Category == category && entry.Test == test && (len(client) == 0 || entry.Client == client[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// selected checks whether a client/test combination (or a simulator on its own)
+// is part of the run, as narrowed down by any requested shard and test plan.
+func selected(category string, test string, client ...string) bool {
+	return shard.contains(category, append([]string{test}, client...)...) && plan.contains(category, test, client...)
+}
+
+// exactPattern assembles a regexp matching exactly the given set of image paths,
+// or an empty pattern if the set is empty.
+func exactPattern(names map[string]bool) string {
+	if len(names) == 0 {
+		return ""
+	}
+	quoted := make([]string, 0, len(names))
+	for name := range names {
+		quoted = append(quoted, regexp.QuoteMeta(name))
+	}
+	sort.Strings(quoted)
+	return "^(" + strings.Join(quoted, "|") + ")$"
+}
@@ -0,0 +1,165 @@
+// This file contains the utility methods for constraining the memory and CPU
+// resources available to client containers.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// cpuPeriod is the CFS scheduler period used to express fractional CPU limits.
+const cpuPeriod = 100000
+
+// errClientOOMKilled is the failure reported for a client container killed by
+// the kernel for exceeding its memory limit, as opposed to the client crashing.
+var errClientOOMKilled = errors.New("client exceeded its memory limit and was killed by the OOM killer")
+
+// resourceLimits is a memory and CPU limit point a container can be run with. The
+// zero value of any field means unlimited.
+type resourceLimits struct {
+	Memory int64   // Maximum memory usable by the container, in bytes
+	CPUs   float64 // Number of (possibly fractional) CPU cores usable by the container
+}
+
+// parseResourceLimits parses a limit point in the form of memory=SIZE,cpus=N,
+// where either of the fields may be omitted and SIZE may use a k, m or g suffix.
+func parseResourceLimits(spec string) (resourceLimits, error) {
+	var limits resourceLimits
+	for _, field := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(parts) != 2 {
+			return resourceLimits{}, fmt.Errorf("invalid resource limit %q, want memory=SIZE,cpus=N", spec)
+		}
+		switch parts[0] {
+		case "memory":
+			memory, err := parseMemorySize(parts[1])
+			if err != nil {
+				return resourceLimits{}, fmt.Errorf("invalid memory limit %q: %v", parts[1], err)
+			}
+			limits.Memory = memory
+		case "cpus":
+			cpus, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil || cpus <= 0 {
+				return resourceLimits{}, fmt.Errorf("invalid cpu limit %q", parts[1])
+			}
+			limits.CPUs = cpus
+		default:
+			return resourceLimits{}, fmt.Errorf("unknown resource %q", parts[0])
+		}
+	}
+	return limits, nil
+}
+
+// parseMemorySize parses a byte count with an optional k, m or g binary suffix.
+func parseMemorySize(size string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(size, "k"):
+		multiplier, size = 1<<10, strings.TrimSuffix(size, "k")
+	case strings.HasSuffix(size, "m"):
+		multiplier, size = 1<<20, strings.TrimSuffix(size, "m")
+	case strings.HasSuffix(size, "g"):
+		multiplier, size = 1<<30, strings.TrimSuffix(size, "g")
+	}
+	value, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if value <= 0 {
+		return 0, fmt.Errorf("non-positive size")
+	}
+	return value * multiplier, nil
+}
+
+// String formats the limit point in its canonical memory=SIZE,cpus=N form.
+func (l resourceLimits) String() string {
+	var fields []string
+	if l.Memory > 0 {
+		size := strconv.FormatInt(l.Memory, 10)
+		switch {
+		case l.Memory%(1<<30) == 0:
+			size = strconv.FormatInt(l.Memory>>30, 10) + "g"
+		case l.Memory%(1<<20) == 0:
+			size = strconv.FormatInt(l.Memory>>20, 10) + "m"
+		case l.Memory%(1<<10) == 0:
+			size = strconv.FormatInt(l.Memory>>10, 10) + "k"
+		}
+		fields = append(fields, "memory="+size)
+	}
+	if l.CPUs > 0 {
+		fields = append(fields, "cpus="+strconv.FormatFloat(l.CPUs, 'f', -1, 64))
+	}
+	return strings.Join(fields, ",")
+}
+
+// parseClientLimits assembles the limits every client container is run with from
+// the -client-memory and -client-cpus flags, or returns nil if neither was set.
+func parseClientLimits(memory string, cpus float64) (*resourceLimits, error) {
+	if memory == "" && cpus == 0 {
+		return nil, nil
+	}
+	limits := new(resourceLimits)
+	if memory != "" {
+		size, err := parseMemorySize(memory)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory limit %q: %v", memory, err)
+		}
+		limits.Memory = size
+	}
+	if cpus < 0 {
+		return nil, fmt.Errorf("invalid cpu limit %v", cpus)
+	}
+	limits.CPUs = cpus
+	return limits, nil
+}
+
+// checkOOMKilled returns errClientOOMKilled if a client container was killed by
+// the kernel's OOM killer, or nil otherwise (including if it cannot be inspected).
+func checkOOMKilled(daemon *dockerClient, id string) error {
+	c, err := daemon.InspectContainer(id)
+	if err == nil && c.State.OOMKilled {
+		return errClientOOMKilled
+	}
+	return nil
+}
+
+// apply configures the limit point on the host config a container is started with.
+func (l resourceLimits) apply(config *docker.HostConfig) {
+	if l.Memory > 0 {
+		config.Memory = l.Memory
+	}
+	if l.CPUs > 0 {
+		config.CPUPeriod = cpuPeriod
+		config.CPUQuota = int64(l.CPUs * cpuPeriod)
+	}
+}
+
+// resourceSweep is a list of limit points to run every benchmark at, implementing
+// flag.Value to allow specifying it on the command line.
+type resourceSweep []resourceLimits
+
+// String implements flag.Value, formatting the limit points semicolon separated.
+func (s *resourceSweep) String() string {
+	points := make([]string, len(*s))
+	for i, limits := range *s {
+		points[i] = limits.String()
+	}
+	return strings.Join(points, ";")
+}
+
+// Set implements flag.Value, parsing a semicolon separated list of limit points.
+func (s *resourceSweep) Set(value string) error {
+	for _, spec := range strings.Split(value, ";") {
+		limits, err := parseResourceLimits(spec)
+		if err != nil {
+			return err
+		}
+		*s = append(*s, limits)
+	}
+	return nil
+}
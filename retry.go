@@ -0,0 +1,32 @@
+// This file contains the backoff policy shared by all the places hive retries a
+// failed operation at, be they docker calls, image builds or webhook deliveries.
+
+package main
+
+import "time"
+
+// backoff is an exponentially growing wait between the attempts of a retried
+// operation, capped so that long retry loops keep polling at a steady pace.
+type backoff struct {
+	delay time.Duration // Time to wait before the next attempt
+	limit time.Duration // Maximum time to wait between two attempts
+}
+
+// newBackoff creates a backoff waiting base before the first retry and doubling
+// the wait on every further one, up to limit.
+func newBackoff(base, limit time.Duration) *backoff {
+	return &backoff{delay: base, limit: limit}
+}
+
+// next returns the time the upcoming wait will take, without waiting.
+func (b *backoff) next() time.Duration {
+	return b.delay
+}
+
+// wait sleeps before the next attempt and grows the wait of the one after it.
+func (b *backoff) wait() {
+	time.Sleep(b.delay)
+	if b.delay *= 2; b.delay > b.limit {
+		b.delay = b.limit
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that the backoff doubles its wait on every retry, up to its limit.
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Millisecond, 5*time.Millisecond)
+
+	want := []time.Duration{1, 2, 4, 5, 5}
+	for i, delay := range want {
+		if have := b.next(); have != delay*time.Millisecond {
+			t.Fatalf("retry %d: wait mismatch: have %v, want %v", i, have, delay*time.Millisecond)
+		}
+		b.wait()
+	}
+}
@@ -0,0 +1,186 @@
+// This file contains the utility methods for comparing the structure of the RPC
+// responses returned by different clients, detecting compatibility drift.
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// rpcSchemaCheck is the set of RPC calls a validator requests hive to issue to
+// every client, comparing the structure of the responses across them.
+type rpcSchemaCheck struct {
+	Reference string          `json:"reference,omitempty"` // Client whose responses are the expected structure (default majority)
+	Calls     []rpcSchemaCall `json:"calls"`               // RPC calls to issue to every client
+}
+
+// rpcSchemaCall is a single RPC request whose response structure is compared.
+type rpcSchemaCall struct {
+	Method string        `json:"method"`           // RPC method to call
+	Params []interface{} `json:"params,omitempty"` // Parameters to call the method with
+}
+
+// schemaDiff is a single field-level structural difference between the response
+// of a client and the expected one.
+type schemaDiff struct {
+	Method   string `json:"method"`   // RPC method whose response differed
+	Path     string `json:"path"`     // Path of the differing field within the response
+	Expected string `json:"expected"` // Expected type of the field (or missing)
+	Actual   string `json:"actual"`   // Type of the field returned by the client (or missing)
+}
+
+// responseShape is the structure of an RPC response, mapping the paths of all the
+// contained fields to their JSON types.
+type responseShape map[string]string
+
+// fetchSchemas issues all the RPC calls of a schema check against a client and
+// gathers the structure of the responses. Failed calls are recorded as an error
+// shape instead of aborting, since failing is a structural difference too.
+func fetchSchemas(ip string, check *rpcSchemaCheck, logger log15.Logger) []responseShape {
+	shapes := make([]responseShape, len(check.Calls))
+	for i, call := range check.Calls {
+		shapes[i] = responseShape{"$": "error"}
+
+		blob, err := callRPC(ip, call.Method, call.Params...)
+		if err != nil {
+			logger.Warn("schema RPC call failed", "method", call.Method, "error", err)
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal(blob, &value); err != nil {
+			logger.Warn("schema RPC response invalid", "method", call.Method, "error", err)
+			continue
+		}
+		shapes[i] = make(responseShape)
+		shapes[i].collect("$", value)
+	}
+	return shapes
+}
+
+// collect walks a decoded JSON value and records the type of each field within.
+// Array elements are all recorded under the same [] suffixed path.
+func (s responseShape) collect(path string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		s[path] = "object"
+		for key, field := range v {
+			s.collect(path+"."+key, field)
+		}
+	case []interface{}:
+		s[path] = "array"
+		for _, elem := range v {
+			s.collect(path+"[]", elem)
+		}
+	case string:
+		s[path] = "string"
+	case float64:
+		s[path] = "number"
+	case bool:
+		s[path] = "bool"
+	default:
+		s[path] = "null"
+	}
+}
+
+// crossCheckSchemas compares the RPC response structures of all the clients that
+// ran the same validator, either against the reference client's or against the
+// ones returned by the majority of clients. Clients with differing responses are
+// failed and the field-level differences recorded.
+func crossCheckSchemas(results map[string]map[string]*validationResult, validator string, check *rpcSchemaCheck, logger log15.Logger) {
+	// Gather the clients that managed to report their responses
+	clients := make([]string, 0, len(results))
+	for client, tests := range results {
+		if result, ok := tests[validator]; ok && result.schemas != nil {
+			clients = append(clients, client)
+		}
+	}
+	sort.Strings(clients)
+	if len(clients) < 2 {
+		return
+	}
+	reference, ok := results[check.Reference][validator]
+	if check.Reference != "" && (!ok || reference.schemas == nil) {
+		logger.Warn("schema reference client missing, using majority", "reference", check.Reference)
+	}
+	for i, call := range check.Calls {
+		// Assemble the expected response structure for this call
+		var expected responseShape
+		if ok && reference.schemas != nil {
+			expected = reference.schemas[i]
+		} else {
+			shapes := make([]responseShape, len(clients))
+			for j, client := range clients {
+				shapes[j] = results[client][validator].schemas[i]
+			}
+			expected = majorityShape(shapes)
+		}
+		// Compare every client's response structure against the expected one
+		for _, client := range clients {
+			result := results[client][validator]
+			for _, diff := range diffShapes(expected, result.schemas[i]) {
+				diff.Method = call.Method
+				logger.Error("client RPC response diverged", "client", client, "method", call.Method, "path", diff.Path, "expected", diff.Expected, "actual", diff.Actual)
+				result.SchemaDiffs = append(result.SchemaDiffs, diff)
+				result.Success = false
+			}
+		}
+	}
+}
+
+// majorityShape assembles a response structure where each field has the type the
+// majority of the shapes agree on, dropping the fields most of them lack.
+func majorityShape(shapes []responseShape) responseShape {
+	paths := make(map[string]bool)
+	for _, shape := range shapes {
+		for path := range shape {
+			paths[path] = true
+		}
+	}
+	majority := make(responseShape)
+	for path := range paths {
+		votes := make(map[string]int)
+		for _, shape := range shapes {
+			if kind, ok := shape[path]; ok {
+				votes[kind]++
+			} else {
+				votes[""]++
+			}
+		}
+		var (
+			best  string
+			count int
+		)
+		for kind, n := range votes {
+			if n > count || (n == count && kind < best) {
+				best, count = kind, n
+			}
+		}
+		if best != "" {
+			majority[path] = best
+		}
+	}
+	return majority
+}
+
+// diffShapes lists the field-level differences between two response structures,
+// sorted by field path.
+func diffShapes(expected, actual responseShape) []schemaDiff {
+	var diffs []schemaDiff
+	for path, kind := range expected {
+		if have, ok := actual[path]; !ok {
+			diffs = append(diffs, schemaDiff{Path: path, Expected: kind, Actual: "missing"})
+		} else if have != kind {
+			diffs = append(diffs, schemaDiff{Path: path, Expected: kind, Actual: have})
+		}
+	}
+	for path, kind := range actual {
+		if _, ok := expected[path]; !ok {
+			diffs = append(diffs, schemaDiff{Path: path, Expected: "missing", Actual: kind})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Path < diffs[j].Path })
+	return diffs
+}
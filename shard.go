@@ -0,0 +1,59 @@
+// This file contains the utility methods for splitting the test matrix into
+// deterministic shards, run independently by separate hive instances.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// testShard is the slice of the test matrix this hive instance is running, in
+// the form of a 1-based shard index out of a total shard count. The zero value
+// runs the entire matrix.
+type testShard struct {
+	index int // 1-based index of the shard to run
+	count int // Total number of shards the matrix is split into
+}
+
+// shard is the parsed value of the -shard flag.
+var shard testShard
+
+// parseShard parses a shard selector in the form of i/n.
+func parseShard(selector string) (testShard, error) {
+	if selector == "" {
+		return testShard{}, nil
+	}
+	parts := strings.Split(selector, "/")
+	if len(parts) != 2 {
+		return testShard{}, fmt.Errorf("invalid shard %q, want i/n", selector)
+	}
+	index, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return testShard{}, fmt.Errorf("invalid shard index %q: %v", parts[0], err)
+	}
+	count, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return testShard{}, fmt.Errorf("invalid shard count %q: %v", parts[1], err)
+	}
+	if count < 1 || index < 1 || index > count {
+		return testShard{}, fmt.Errorf("invalid shard %q, want 1 <= i <= n", selector)
+	}
+	return testShard{index: index, count: count}, nil
+}
+
+// contains checks whether a single entry of the test matrix belongs to this shard.
+// Entries are identified by their category followed by their names (test, then
+// client if the category runs client/test pairs), joined by slashes. The entry
+// belongs to shard i/n if the FNV-1a 32 bit hash of its identifier modulo n is
+// i-1.
+func (s testShard) contains(category string, names ...string) bool {
+	if s.count <= 1 {
+		return true
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(strings.Join(append([]string{category}, names...), "/")))
+	return int(hash.Sum32()%uint32(s.count)) == s.index-1
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Tests that shard selectors are parsed and invalid ones rejected.
+func TestParseShard(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     testShard
+		fail     bool
+	}{
+		{"", testShard{}, false},
+		{"1/1", testShard{index: 1, count: 1}, false},
+		{"2/4", testShard{index: 2, count: 4}, false},
+		{"4/4", testShard{index: 4, count: 4}, false},
+		{"0/4", testShard{}, true},
+		{"5/4", testShard{}, true},
+		{"1/0", testShard{}, true},
+		{"-1/4", testShard{}, true},
+		{"1", testShard{}, true},
+		{"1/2/3", testShard{}, true},
+		{"a/4", testShard{}, true},
+		{"1/b", testShard{}, true},
+	}
+	for _, tt := range tests {
+		have, err := parseShard(tt.selector)
+		if (err != nil) != tt.fail {
+			t.Errorf("%q: failure mismatch: have %v, want failure %v", tt.selector, err, tt.fail)
+			continue
+		}
+		if have != tt.want {
+			t.Errorf("%q: shard mismatch: have %+v, want %+v", tt.selector, have, tt.want)
+		}
+	}
+}
+
+// Tests that every entry of the test matrix belongs to exactly one shard, that
+// the unsharded matrix contains everything, and that the partitioning is stable
+// across runs (and hive versions), as separate instances rely on it.
+func TestShardPartition(t *testing.T) {
+	for count := 1; count <= 7; count++ {
+		for i := 0; i < 100; i++ {
+			test := fmt.Sprintf("test-%d", i)
+
+			owners := 0
+			for index := 1; index <= count; index++ {
+				if (testShard{index: index, count: count}).contains("validator", test, "go-ethereum:master") {
+					owners++
+				}
+			}
+			if owners != 1 {
+				t.Errorf("%s in %d shards: have %d owners, want 1", test, count, owners)
+			}
+		}
+	}
+	if !(testShard{}).contains("validator", "any", "client") {
+		t.Errorf("unsharded matrix misses entry")
+	}
+	// Pin a few assignments, changing them would silently reshuffle CI shards
+	pinned := []struct {
+		category string
+		names    []string
+		index    int
+	}{
+		{"validator", []string{"smoke/genesis", "go-ethereum:master"}, 4},
+		{"simulator", []string{"devp2p"}, 2},
+		{"benchmarker", []string{"blockchain", "go-ethereum:master/full"}, 2},
+	}
+	for _, tt := range pinned {
+		if !(testShard{index: tt.index, count: 4}).contains(tt.category, tt.names...) {
+			t.Errorf("%s %v: not in shard %d/4 any more", tt.category, tt.names, tt.index)
+		}
+	}
+}
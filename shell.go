@@ -1,8 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
-	"os/signal"
 
 	"github.com/fsouza/go-dockerclient"
 	"gopkg.in/inconshreveable/log15.v2"
@@ -14,19 +15,27 @@ import (
 //
 // The end goal of this mechanism is preventing any leakage of junk (be that file
 // system, docker images and/or containers, network traffic) into the host system.
-func mainInShell(daemon *docker.Client, overrides []string, cacher *buildCacher) error {
+func mainInShell(daemon *dockerClient, overrides []string, cacher *buildCacher) (*runSummary, error) {
+	// Create the file the inner hive hands its run summary over in
+	handoff, err := ioutil.TempFile("", "hive-summary-")
+	if err != nil {
+		return nil, err
+	}
+	handoff.Close()
+	defer os.Remove(handoff.Name())
+
 	// Build the image for the outer shell container and the container itself
 	log15.Info("creating outer shell container")
 
 	image, err := buildShell(daemon, cacher)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// Create the shell container and make sure it's deleted afterwards
-	shell, err := createShellContainer(daemon, image, overrides)
+	shell, err := createShellContainer(daemon, image, overrides, handoff.Name())
 	if err != nil {
 		log15.Error("failed to create shell container", "error", err)
-		return err
+		return nil, err
 	}
 	log15.Debug("created shell container")
 	defer func() {
@@ -38,24 +47,28 @@ func mainInShell(daemon *docker.Client, overrides []string, cacher *buildCacher)
 	// Start up a hive instance within the shell
 	log15.Info("starting outer shell container")
 
-	waiter, err := runContainer(daemon, shell.ID, log15.Root(), "", true)
+	waiter, err := runContainer(daemon, shell.ID, log15.Root(), "", true, nil)
 	if err != nil {
 		log15.Error("failed to execute hive shell", "error", err)
-		return err
+		return nil, err
 	}
-	// Register an interrupt handler to cleanly tear the shell down
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-
-	go func() {
-		<-interrupt
-		log15.Error("shell interrupted, stopping")
-		err := daemon.StopContainer(shell.ID, 0)
-		if err != nil {
-			log15.Error("failed to stop hive shell", "error", err)
-		}
-	}()
-	// Wait for container termination and return
+	// Wait for container termination and forward any failure of the inner hive
 	waiter.Wait()
-	return nil
+
+	summary, err := readShellSummary(handoff.Name())
+	if err != nil {
+		log15.Error("failed to read hive shell summary", "error", err)
+	}
+	if terminated() {
+		return summary, errTerminated
+	}
+	c, err := daemon.InspectContainer(shell.ID)
+	if err != nil {
+		log15.Error("failed to inspect hive shell", "error", err)
+		return summary, err
+	}
+	if c.State.ExitCode != 0 {
+		return summary, fmt.Errorf("hive shell exited with code %d", c.State.ExitCode)
+	}
+	return summary, nil
 }
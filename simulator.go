@@ -21,10 +21,18 @@ import (
 // various metadata as well as possibly multiple sub-results in case where
 // the same simulator tested multiple things in one go.
 type simulationResult struct {
-	Start   time.Time `json:"start"`           // Time instance when the simulation ended
-	End     time.Time `json:"end"`             // Time instance when the simulation ended
-	Success bool      `json:"success"`         // Whether the entire simulation succeeded
-	Error   error     `json:"error,omitempty"` // Potential hive failure during simulation
+	Start   time.Time `json:"start"`             // Time instance when the simulation ended
+	End     time.Time `json:"end"`               // Time instance when the simulation ended
+	Success bool      `json:"success"`           // Whether the entire simulation succeeded
+	Error   error     `json:"error,omitempty"`   // Potential hive failure during simulation
+	Skipped bool      `json:"skipped,omitempty"` // Whether the simulation was skipped via -sim-skip
+	NotRun  bool      `json:"notRun,omitempty"`  // Whether the simulator reported no subresults for the client
+	Timeout string    `json:"timeout,omitempty"` // Effective timeout applied to the client's nodes
+
+	TruncatedLogs []string `json:"truncatedLogs,omitempty"` // Captured logs that exceeded the size cap and lost their heads
+	ClientLog     string   `json:"clientLog,omitempty"`     // Client logs exported into -logdir, if any
+
+	Provisioning time.Duration `json:"provisioning,omitempty"` // Total time spent starting the client's nodes (ns)
 
 	Subresults []simulationSubresult `json:"subresults,omitempty"` // Optional list of subresults to report
 
@@ -36,9 +44,26 @@ type simulationResultSummary struct {
 	Success bool      `json:"success"`         // Whether the entire simulation succeeded
 	Error   error     `json:"error,omitempty"` // Potential hive failure during simulation
 
+	Skipped bool `json:"skipped,omitempty"` // Whether the simulation was skipped via -sim-skip
+	NotRun  bool `json:"notRun,omitempty"`  // Whether the simulator reported no subresults for the client
+
 	summaryData
 }
 
+// finish decides the outcome of a client's simulation once the simulator exited.
+// The client only passed if the simulator reported subresults for it, all of them
+// passing. Clients without any subresults (and no hive failure) were not tested
+// by the simulator at all, so they are recorded as not run instead.
+func (r *simulationResult) finish() {
+	r.NotRun = r.Error == nil && len(r.Subresults) == 0
+	r.Success = r.Error == nil && len(r.Subresults) > 0
+	for _, subresult := range r.Subresults {
+		if !subresult.Success {
+			r.Success = false
+		}
+	}
+}
+
 // simulationSubresult represents a sub-test a simulation may run and report.
 type simulationSubresult struct {
 	Name string `json:"name"` // Unique name for a sub-test within a simulation
@@ -48,10 +73,15 @@ type simulationSubresult struct {
 	Details json.RawMessage `json:"details,omitempty"` // Structured infos a tester mightw wish to surface
 }
 
+// maxSimStartParallelism is the upper limit of simulation node containers allowed
+// to be started concurrently, to avoid overwhelming the docker daemon.
+const maxSimStartParallelism = 32
+
 // simulateClients runs a batch of simulation tests matched by simulatorPattern
 // against a set of clients matching clientPattern, where  the simulator decides
-// which of those clients to invoke
-func simulateClients(daemon *docker.Client, clientPattern, simulatorPattern string, overrides []string, cacher *buildCacher) (map[string]map[string]*simulationResult, error) {
+// which of those clients to invoke. Every result is passed to onResult as soon as
+// its simulation finished.
+func simulateClients(daemon *dockerClient, clientPattern, simulatorPattern string, overrides []string, cacher *buildCacher, onResult resultHook) (map[string]map[string]*simulationResult, error) {
 	// Build all the clients matching the validation pattern
 	log15.Info("building clients for simulation", "pattern", clientPattern)
 	clients, err := buildClients(daemon, clientPattern, cacher)
@@ -60,8 +90,8 @@ func simulateClients(daemon *docker.Client, clientPattern, simulatorPattern stri
 	}
 
 	// Build all the simulators known to the test harness
-	log15.Info("building simulators for testing", "pattern", simulatorPattern)
-	simulators, err := buildSimulators(daemon, simulatorPattern, cacher)
+	log15.Info("building simulators for testing", "pattern", simulatorPattern, "skip", *simSkipPattern)
+	simulators, skipped, err := buildSimulators(daemon, simulatorPattern, *simSkipPattern, cacher)
 	if err != nil {
 		return nil, err
 	}
@@ -74,36 +104,90 @@ func simulateClients(daemon *docker.Client, clientPattern, simulatorPattern stri
 		results[client] = make(map[string]*simulationResult)
 	}
 
-	//set the end time of the test
+	//set the end time of the tests not finished individually
 	defer func() {
 		for _, cv := range results {
 			for _, sv := range cv {
-				sv.End = time.Now()
+				if sv.End.IsZero() {
+					sv.End = time.Now()
+				}
 			}
 		}
 	}()
 
+	// Record the skipped simulators against every client, so the reports show them
+	// as deliberately not run instead of omitting them
+	for _, simulator := range skipped {
+		if !selected("simulator", simulator) {
+			continue
+		}
+		for client := range clients {
+			now := time.Now()
+			results[client][simulator] = &simulationResult{Start: now, End: now, Skipped: true}
+			onResult("simulator", client, simulator, false, 0, results[client][simulator])
+		}
+		log15.Info("simulation skipped", "simulator", simulator)
+	}
+	// Prepare the results of all simulators upfront, since the result maps are
+	// shared between concurrently running simulations
+	var jobs []func() error
 	for simulator, simulatorImage := range simulators {
-
+		// Simulators pick their own clients, so shard by simulator alone
+		if !selected("simulator", simulator) {
+			continue
+		}
+		meta, err := loadTestMetadata("simulators", simulator)
+		if err != nil {
+			return nil, err
+		}
 		logdir, err := makeTestOutputDirectory(strings.Replace(simulator, string(filepath.Separator), "_", -1), "simulator", clients)
 		if err != nil {
 			return nil, err
 		}
-
-		logger := log15.New("simulator", simulator)
-
 		for client := range clients {
-			results[client][simulator] = &simulationResult{
-				Start: time.Now(),
-			}
-
+			results[client][simulator] = new(simulationResult)
 		}
-
-		err = simulate(daemon, clients, simulatorImage, simulator, overrides, logger, logdir, results) //filepath.Join(logdir, strings.Replace(client, string(filepath.Separator), "_", -1)))
-		if err != nil {
-			return nil, err
+		// If a genesis was requested, initialize all the nodes from it
+		var genesis string
+		if spec := meta.testGenesis(); spec != nil {
+			genesis = spec.path
 		}
+		simulator, simulatorImage := simulator, simulatorImage
+
+		jobs = append(jobs, func() error {
+			logger := log15.New("simulator", simulator)
 
+			for client := range clients {
+				results[client][simulator].Start = time.Now()
+			}
+			err := simulate(daemon, clients, simulatorImage, simulator, overrides, meta.testTimeout(), genesis, logger, logdir, results) //filepath.Join(logdir, strings.Replace(client, string(filepath.Separator), "_", -1)))
+			if err != nil {
+				return err
+			}
+			// Decide the outcome of every client, note any logs that were truncated
+			// due to exceeding the size cap and export the client logs if requested
+			for client := range clients {
+				result := results[client][simulator]
+				result.finish()
+				clientdir := filepath.Join(logdir, strings.Replace(client, string(filepath.Separator), "_", -1))
+
+				logs := truncatedLogsIn(filepath.Join(logdir, "simulator.log"))
+				logs = append(logs, truncatedLogsIn(clientdir)...)
+				result.TruncatedLogs = logs
+
+				sources, _ := filepath.Glob(filepath.Join(clientdir, "client-*.log"))
+				if result.ClientLog, err = exportTestLogs(client, simulator, result.Success, sources); err != nil {
+					logger.Error("failed to export client logs", "client", client, "error", err)
+				}
+				result.End = time.Now()
+				recordTest("simulator", result.Success, result.End.Sub(result.Start))
+				onResult("simulator", client, simulator, result.Success, result.End.Sub(result.Start), result)
+			}
+			return nil
+		})
+	}
+	if err := runParallel(*parallelFlag, jobs); err != nil {
+		return nil, err
 	}
 	return results, nil
 }
@@ -111,11 +195,11 @@ func simulateClients(daemon *docker.Client, clientPattern, simulatorPattern stri
 // simulate starts a simulator service locally, starts a controlling container
 // and executes its commands until torn down. The exit status of the controller
 // container will signal whether the simulation passed or failed.
-func simulate(daemon *docker.Client, clients map[string]string, simulator string, simulatorLabel string, overrides []string, logger log15.Logger, logdir string, results map[string]map[string]*simulationResult) error {
+func simulate(daemon *dockerClient, clients map[string]string, simulator string, simulatorLabel string, overrides []string, timeout time.Duration, genesis string, logger log15.Logger, logdir string, results map[string]map[string]*simulationResult) error {
 	logger.Info("running client simulation")
 
 	// Start the simulator HTTP API
-	sim, err := startSimulatorAPI(daemon, clients, simulator, simulatorLabel, overrides, logger, logdir, results)
+	sim, err := startSimulatorAPI(daemon, clients, simulator, simulatorLabel, overrides, timeout, genesis, logger, logdir, results)
 	if err != nil {
 		logger.Error("failed to start simulator API", "error", err)
 		return err
@@ -129,10 +213,10 @@ func simulate(daemon *docker.Client, clients map[string]string, simulator string
 	sc, err := daemon.CreateContainer(docker.CreateContainerOptions{
 		Config: &docker.Config{
 			Image: simulator,
-			Env: []string{"HIVE_SIMULATOR=http://" + sim.listener.Addr().String(),
+			Env: append([]string{"HIVE_SIMULATOR=http://" + sim.listener.Addr().String(),
 				"HIVE_DEBUG=" + strconv.FormatBool(*hiveDebug),
 				"HIVE_PARALLELISM=" + fmt.Sprintf("%d", simulatorParallelism),
-			},
+			}, globalSetupEnvs()...),
 		},
 		HostConfig: hostConfig,
 	})
@@ -155,20 +239,40 @@ func simulate(daemon *docker.Client, clients map[string]string, simulator string
 
 	// Start the tester container and wait until it finishes
 	slogger.Debug("running simulator container")
-	waiter, err := runContainer(daemon, sc.ID, slogger, filepath.Join(logdir, "simulator.log"), false)
+	waiter, err := runContainer(daemon, sc.ID, slogger, filepath.Join(logdir, "simulator.log"), false, nil)
 	if err != nil {
 		slogger.Error("failed to run simulator", "error", err)
 		return err
 	}
 	waiter.Wait()
 
-	return nil
+	// Fail the simulation for every client if the simulator itself crashed
+	c, err := daemon.InspectContainer(sc.ID)
+	if err != nil {
+		slogger.Error("failed to inspect simulator", "error", err)
+		return err
+	}
+	if c.State.ExitCode != 0 {
+		slogger.Error("simulator failed", "exitcode", c.State.ExitCode)
+		failure := fmt.Errorf("simulator exited with code %d", c.State.ExitCode)
 
+		sim.lock.Lock()
+		for client := range clients {
+			if result := results[client][simulatorLabel]; result != nil {
+				result.Success = false
+				if result.Error == nil {
+					result.Error = failure
+				}
+			}
+		}
+		sim.lock.Unlock()
+	}
+	return nil
 }
 
 // startSimulatorAPI starts an HTTP webserver listening for simulator commands
 // on the docker bridge and executing them until it is torn down.
-func startSimulatorAPI(daemon *docker.Client, clients map[string]string, simulator string, simulatorLabel string, overrides []string, logger log15.Logger, logdir string, results map[string]map[string]*simulationResult) (*simulatorAPIHandler, error) {
+func startSimulatorAPI(daemon *dockerClient, clients map[string]string, simulator string, simulatorLabel string, overrides []string, timeout time.Duration, genesis string, logger log15.Logger, logdir string, results map[string]map[string]*simulationResult) (*simulatorAPIHandler, error) {
 	// Find the IP address of the host container
 	logger.Debug("looking up docker bridge IP")
 	bridge, err := lookupBridgeIP(logger)
@@ -189,6 +293,14 @@ func startSimulatorAPI(daemon *docker.Client, clients map[string]string, simulat
 	}
 	logger.Debug("listening for simulator commands", "ip", bridge, "port", listener.Addr().(*net.TCPAddr).Port)
 
+	// Clamp the node startup parallelism to sane bounds
+	parallelism := *simStartParallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	if parallelism > maxSimStartParallelism {
+		parallelism = maxSimStartParallelism
+	}
 	// Serve connections until the listener is terminated
 	logger.Debug("starting simulator API server")
 	sim := &simulatorAPIHandler{
@@ -200,12 +312,15 @@ func startSimulatorAPI(daemon *docker.Client, clients map[string]string, simulat
 		simulator:        simulator,
 		simulatorLabel:   simulatorLabel,
 		overrides:        overrides,
+		timeout:          timeout,
+		genesis:          genesis,
 		nodes:            make(map[string]*docker.Container),
 		nodeNames:        make(map[string]string),
 		nodesTimeout:     make(map[string]time.Time),
+		provisioners:     make(chan struct{}, parallelism),
 		result:           results, //the simulator now has access to a map of results-by-client. The simulator decides which clients to run/
 	}
-	go sim.CheckTimeout()
+	trackSimulation(sim)
 	go http.Serve(listener, sim)
 
 	return sim, nil
@@ -216,39 +331,84 @@ func startSimulatorAPI(daemon *docker.Client, clients map[string]string, simulat
 type simulatorAPIHandler struct {
 	listener *net.TCPListener
 
-	daemon           *docker.Client
+	daemon           *dockerClient
 	logger           log15.Logger
 	logdir           string
 	availableClients map[string]string //the client filter specified by the host. Simulations may not execute other clients.
 	simulator        string            //the image name
 	simulatorLabel   string            //the simulator label
 	overrides        []string
+	timeout          time.Duration // Base timeout of the simulation's nodes, before client scaling
+	genesis          string        // Genesis file to initialize the nodes with, empty for the simulator's own
 	autoID           uint32
 
 	runner       *docker.Container
 	nodes        map[string]*docker.Container
 	nodeNames    map[string]string
 	nodesTimeout map[string]time.Time
+	provisioners chan struct{}  // Semaphore limiting the concurrent node startups
+	waiters      sync.WaitGroup // Log streams of the started nodes, joined on teardown
 
 	result map[string]map[string]*simulationResult //simulation result log per client name
 	lock   sync.RWMutex
 }
 
-// CheckTimeout is a goroutine that checks if the timeout has passed and stops
-// container if it has.
-func (h *simulatorAPIHandler) CheckTimeout() {
+// Simulations in flight, tracked so that a single goroutine can terminate the
+// timed out nodes of all of them.
+var (
+	simulations     = make(map[*simulatorAPIHandler]struct{})
+	simulationsLock sync.Mutex
+	timeoutChecker  sync.Once
+)
+
+// trackSimulation registers a simulation for node timeout checks, starting the
+// checker goroutine if it is not yet running.
+func trackSimulation(h *simulatorAPIHandler) {
+	simulationsLock.Lock()
+	simulations[h] = struct{}{}
+	simulationsLock.Unlock()
+
+	timeoutChecker.Do(func() { go checkTimeouts() })
+}
+
+// untrackSimulation removes a torn down simulation from the node timeout checks.
+func untrackSimulation(h *simulatorAPIHandler) {
+	simulationsLock.Lock()
+	delete(simulations, h)
+	simulationsLock.Unlock()
+}
+
+// checkTimeouts is a goroutine that periodically checks the nodes of all the
+// simulations in flight, stopping the ones whose timeout has passed.
+func checkTimeouts() {
 	for {
-		h.lock.Lock()
-		for id, c := range h.nodes {
-			if !c.State.Running || (time.Now().After(h.nodesTimeout[id])) {
-				h.terminateContainer(id, nil)
-			}
+		simulationsLock.Lock()
+		handlers := make([]*simulatorAPIHandler, 0, len(simulations))
+		for h := range simulations {
+			handlers = append(handlers, h)
+		}
+		simulationsLock.Unlock()
+
+		for _, h := range handlers {
+			h.CheckTimeout()
 		}
-		h.lock.Unlock()
 		time.Sleep(timeoutCheckDuration)
 	}
 }
 
+// CheckTimeout checks if the timeout of any of the simulation's nodes has passed
+// and stops the containers that it has.
+func (h *simulatorAPIHandler) CheckTimeout() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for id, c := range h.nodes {
+		if !c.State.Running || (time.Now().After(h.nodesTimeout[id])) {
+			h.terminateContainer(id, nil)
+		}
+	}
+}
+
 func (h *simulatorAPIHandler) terminateContainer(id string, w http.ResponseWriter) {
 	node, ok := h.nodes[id]
 	delete(h.nodes, id) // Almost correct, removal may fail. Lock is too expensive though
@@ -262,7 +422,7 @@ func (h *simulatorAPIHandler) terminateContainer(id string, w http.ResponseWrite
 		return
 	}
 	h.logger.Debug("deleting client container", "id", node.ID[:8])
-	if err := h.daemon.RemoveContainer(docker.RemoveContainerOptions{ID: node.ID, Force: true}); err != nil {
+	if err := h.removeClient(id, node); err != nil {
 		h.logger.Error("failed to delete client ", "id", id, "error", err)
 		if w != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -270,6 +430,26 @@ func (h *simulatorAPIHandler) terminateContainer(id string, w http.ResponseWrite
 	}
 }
 
+// removeClient deletes a client container of the simulation. If the client was
+// killed for exceeding its memory limit, its simulation is failed with a resource
+// limit failure first, while the container can still be inspected. The caller
+// must hold the lock.
+func (h *simulatorAPIHandler) removeClient(id string, node *docker.Container) error {
+	if err := checkOOMKilled(h.daemon, node.ID); err != nil {
+		h.logger.Error("client container killed by the OOM killer", "id", id)
+		h.failClient(h.nodeNames[id], err)
+	}
+	return h.daemon.RemoveContainer(docker.RemoveContainerOptions{ID: node.ID, Force: true})
+}
+
+// failClient marks the simulation of a client failed. The caller must hold the lock.
+func (h *simulatorAPIHandler) failClient(client string, err error) {
+	if result := h.result[client][h.simulatorLabel]; result != nil {
+		result.Success = false
+		result.Error = err
+	}
+}
+
 // ServeHTTP handles all the simulator API requests and executes them.
 func (h *simulatorAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	logger := h.logger.New("req-id", atomic.AddUint32(&h.autoID, 1))
@@ -384,9 +564,23 @@ func (h *simulatorAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 				return
 			}
 
+			// Scale the node timeout by any client specific multiplier
+			meta, err := loadClientMetadata(clientName)
+			if err != nil {
+				logger.Error("failed to load client metadata", "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			timeout := meta.timeout(h.timeout)
+
+			// Wait for a free provisioning slot to avoid overloading the daemon
+			h.provisioners <- struct{}{}
+			defer func() { <-h.provisioners }()
+			provisionStart := time.Now()
+
 			// Create and start the requested client container
 			logger.Debug("starting new client")
-			container, err := createClientContainer(h.daemon, imageName, h.simulator, h.runner, h.overrides, envs)
+			container, err := createClientContainer(h.daemon, imageName, h.simulator, h.runner, h.overrides, envs, h.genesis)
 			if err != nil {
 				logger.Error("failed to create client", "error", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -398,13 +592,16 @@ func (h *simulatorAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 
 			logfile := fmt.Sprintf("client-%s.log", containerID)
 
-			waiter, err := runContainer(h.daemon, container.ID, logger, filepath.Join(h.logdir, strings.Replace(clientName, string(filepath.Separator), "_", -1), logfile), false)
+			waiter, err := runContainer(h.daemon, container.ID, logger, filepath.Join(h.logdir, strings.Replace(clientName, string(filepath.Separator), "_", -1), logfile), false, clientLimits)
 			if err != nil {
 				logger.Error("failed to start client", "error", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			h.waiters.Add(1)
 			go func() {
+				defer h.waiters.Done()
+
 				// Ensure the goroutine started by runContainer exits, so that
 				// its resources (e.g. the logfile it creates) can be garbage
 				// collected.
@@ -423,10 +620,20 @@ func (h *simulatorAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 				if err != nil {
 					logger.Error("failed to inspect client", "error", err)
 					http.Error(w, err.Error(), http.StatusInternalServerError)
+
+					// Untracked and possibly alive, so delete it lest teardown waits on it
+					h.daemon.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true})
 					return
 				}
 				if !c.State.Running {
-					logger.Error("client container terminated")
+					logger.Error("client container terminated", "oomkilled", c.State.OOMKilled)
+					if c.State.OOMKilled {
+						h.lock.Lock()
+						h.failClient(clientName, errClientOOMKilled)
+						h.lock.Unlock()
+						http.Error(w, errClientOOMKilled.Error(), http.StatusInternalServerError)
+						return
+					}
 					http.Error(w, "terminated unexpectedly", http.StatusInternalServerError)
 					return
 				}
@@ -443,7 +650,9 @@ func (h *simulatorAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 			h.lock.Lock()
 			h.nodes[containerID] = container
 			h.nodeNames[containerID] = clientName
-			h.nodesTimeout[containerID] = time.Now().Add(dockerTimeoutDuration)
+			h.nodesTimeout[containerID] = time.Now().Add(timeout)
+			h.result[clientName][h.simulatorLabel].Timeout = timeout.String()
+			h.result[clientName][h.simulatorLabel].Provisioning += time.Since(provisionStart)
 			h.lock.Unlock()
 			return
 
@@ -461,16 +670,6 @@ func (h *simulatorAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 				return
 			}
 
-			//If there has been a failure, update the whole test result
-			//which at present means updating the result set for each
-			//known client. TODO: the output format should be
-			//re-arranged so that it is grouped first by test and then by client instance type
-			if !success {
-				for _, resultset := range h.result {
-					resultset[h.simulatorLabel].Success = false
-				}
-			}
-
 			nodeid := r.Form.Get("nodeid")
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
@@ -524,11 +723,18 @@ func (h *simulatorAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 func (h *simulatorAPIHandler) Close() {
 	h.logger.Debug("terminating simulator server")
 	h.listener.Close()
+	untrackSimulation(h)
 
-	for _, node := range h.nodes {
+	h.lock.Lock()
+	for id, node := range h.nodes {
 		h.logger.Debug("deleting client container", "id", node.ID[:8])
-		if err := h.daemon.RemoveContainer(docker.RemoveContainerOptions{ID: node.ID, Force: true}); err != nil {
+		if err := h.removeClient(id, node); err != nil {
 			h.logger.Error("failed to delete client container", "id", node.ID[:8], "error", err)
 		}
 	}
+	h.lock.Unlock()
+
+	// Wait for the log streams of all the nodes to end, so no client outlives the
+	// simulation and its results are final once torn down
+	h.waiters.Wait()
 }
@@ -0,0 +1,84 @@
+// This file contains the utility methods for streaming the results of a hive run
+// as newline delimited JSON while it is still in progress.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// resultHook is a callback invoked with every test result as soon as it is final,
+// before the full result set of the test category is assembled.
+type resultHook func(category string, client string, test string, success bool, elapsed time.Duration, result interface{})
+
+// streamedResult is a single finished test, encoded as one line of the stream.
+type streamedResult struct {
+	Category string        `json:"category"` // Kind of the test (validator, simulator or benchmarker)
+	Client   string        `json:"client"`   // Client (and sync mode) the test ran against
+	Test     string        `json:"test"`     // Name of the test
+	Success  bool          `json:"success"`  // Whether the test passed
+	Duration time.Duration `json:"duration"` // Time it took to run the test (ns)
+	Result   interface{}   `json:"result"`   // Full result of the test, as in the final report
+}
+
+// resultStream writes finished test results into a file or stdout as newline
+// delimited JSON. A nil stream silently drops all results.
+type resultStream struct {
+	out  io.Writer
+	file *os.File // Opened stream file, nil if streaming to stdout
+	lock sync.Mutex
+}
+
+// openResultStream creates the stream requested via -stream, which is a file path
+// or - for stdout. An empty path disables streaming, returning a nil stream.
+func openResultStream(path string) (*resultStream, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		return &resultStream{out: os.Stdout}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &resultStream{out: file, file: file}, nil
+}
+
+// report implements resultHook, writing a single finished test into the stream.
+func (s *resultStream) report(category string, client string, test string, success bool, elapsed time.Duration, result interface{}) {
+	if s == nil {
+		return
+	}
+	blob, err := json.Marshal(streamedResult{Category: category, Client: client, Test: test, Success: success, Duration: elapsed, Result: result})
+	if err != nil {
+		log15.Error("failed to encode streamed result", "category", category, "client", client, "test", test, "error", err)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, err := s.out.Write(append(blob, '\n')); err != nil {
+		log15.Error("failed to stream result", "category", category, "client", client, "test", test, "error", err)
+	}
+}
+
+// close closes the stream file, if any.
+func (s *resultStream) close() {
+	if s == nil || s.file == nil {
+		return
+	}
+	if err := s.file.Close(); err != nil {
+		log15.Error("failed to close result stream", "error", err)
+	}
+}
@@ -0,0 +1,202 @@
+// This file contains the utility methods for condensing the results of a hive
+// run into a compact summary, reported to webhooks and the logs.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// runSummary is the compact summary of a hive run, counting the passed and failed
+// tests per client.
+type runSummary struct {
+	Run       string                  `json:"run"`                 // Identifier of the run (its start timestamp)
+	Success   bool                    `json:"success"`             // Whether every test of the non-experimental clients passed
+	Passed    int                     `json:"passed"`              // Total number of tests passed
+	Failed    int                     `json:"failed"`              // Total number of tests failed
+	Skipped   int                     `json:"skipped,omitempty"`   // Total number of tests skipped via -test-skip or -sim-skip
+	Clients   map[string]*resultCount `json:"clients"`             // Passed and failed test counts per client
+	Maturity  map[string]*resultCount `json:"maturity"`            // Passed and failed test counts per client maturity level
+	ResultURL string                  `json:"resultUrl,omitempty"` // Link to the full report, if known
+
+	Categories  map[string]*resultCount `json:"categories"`         // Passed and failed test counts per category (builds, validations, simulations, benchmarks)
+	ClientCount int                     `json:"clientCount"`        // Number of clients tested (including the ones failing to build)
+	Status      string                  `json:"status,omitempty"`   // Outcome of the finished run (pass, fail or error)
+	Duration    time.Duration           `json:"duration,omitempty"` // Time the finished run took (ns)
+}
+
+// resultCount is the number of passed and failed tests of a single client.
+type resultCount struct {
+	Passed int `json:"passed"`
+	Failed int `json:"failed"`
+}
+
+// summariseRun counts the passed and failed validations, simulations and benchmarks
+// of every client in a result set. Failures of experimental clients are counted,
+// but do not fail the run. Skipped tests are only counted in the total, clients a
+// simulator did not run are not counted at all, while clients that failed to build
+// count as a single failed test each.
+func summariseRun(results *resultSet, resultURL string) *runSummary {
+	summary := &runSummary{
+		Run:       runPath,
+		Success:   true,
+		Clients:   make(map[string]*resultCount),
+		Maturity:  make(map[string]*resultCount),
+		ResultURL: resultURL,
+
+		Categories:  make(map[string]*resultCount),
+		ClientCount: len(results.Clients),
+	}
+	maturities := make(map[string]string)
+	count := func(category string, key string, client string, success bool) {
+		if _, ok := maturities[client]; !ok {
+			maturities[client] = clientMaturity(client)
+		}
+		maturity := maturities[client]
+		if summary.Clients[key] == nil {
+			summary.Clients[key] = new(resultCount)
+		}
+		if summary.Maturity[maturity] == nil {
+			summary.Maturity[maturity] = new(resultCount)
+		}
+		if summary.Categories[category] == nil {
+			summary.Categories[category] = new(resultCount)
+		}
+		if success {
+			summary.Clients[key].Passed++
+			summary.Maturity[maturity].Passed++
+			summary.Categories[category].Passed++
+			summary.Passed++
+		} else {
+			summary.Clients[key].Failed++
+			summary.Maturity[maturity].Failed++
+			summary.Categories[category].Failed++
+			summary.Failed++
+			if maturity != maturityExperimental {
+				summary.Success = false
+			}
+		}
+	}
+	for client, version := range results.Clients {
+		if version["error"] != "" {
+			count("builds", client, client, false)
+		}
+	}
+	for key, tests := range results.Validations {
+		for _, result := range tests {
+			if result.Skipped {
+				summary.Skipped++
+				continue
+			}
+			count("validations", key, strings.TrimSuffix(key, "/"+result.SyncMode), result.Success)
+		}
+	}
+	for client, tests := range results.Simulations {
+		for _, result := range tests {
+			if result.Skipped {
+				summary.Skipped++
+				continue
+			}
+			if result.NotRun {
+				continue
+			}
+			count("simulations", client, client, result.Success)
+		}
+	}
+	for key, tests := range results.Benchmarks {
+		for _, result := range tests {
+			count("benchmarks", key, strings.TrimSuffix(key, "/"+result.SyncMode), result.Success)
+		}
+	}
+	return summary
+}
+
+// finish records the outcome and duration of the finished run in its summary. A
+// failure other than the tests failing means the run itself errored.
+func (s *runSummary) finish(elapsed time.Duration, fail error) {
+	s.Status = "pass"
+	switch {
+	case fail != nil && fail != errTestsFailed:
+		s.Status = "error"
+	case !s.Success:
+		s.Status = "fail"
+	}
+	s.Duration = elapsed
+}
+
+// passRate returns the fraction of passed tests, or zero if none ran.
+func (c *resultCount) passRate() float64 {
+	if c.Passed+c.Failed == 0 {
+		return 0
+	}
+	return float64(c.Passed) / float64(c.Passed+c.Failed)
+}
+
+// logRunSummary emits a single structured line summarising the finished run, meant
+// for log aggregators. It bypasses the log level filter and is always formatted as
+// logfmt unless JSON logs were requested.
+func logRunSummary(summary *runSummary) {
+	// Find the client with the most failures to highlight
+	clients := make([]string, 0, len(summary.Clients))
+	for client := range summary.Clients {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+
+	var worst string
+	for _, client := range clients {
+		if count := summary.Clients[client]; count.Failed > 0 && (worst == "" || count.Failed > summary.Clients[worst].Failed) {
+			worst = client
+		}
+	}
+	format := log15.LogfmtFormat()
+	if *logFormat == "json" {
+		format = log15.JsonFormat()
+	}
+	logger := log15.New()
+	logger.SetHandler(log15.StreamHandler(os.Stderr, format))
+	ctx := []interface{}{"run", summary.Run, "status", summary.Status, "passed", summary.Passed, "failed", summary.Failed,
+		"skipped", summary.Skipped, "clients", len(clients), "worst", worst, "duration", summary.Duration.Round(time.Millisecond)}
+
+	maturities := make([]string, 0, len(summary.Maturity))
+	for maturity := range summary.Maturity {
+		maturities = append(maturities, maturity)
+	}
+	sort.Strings(maturities)
+	for _, maturity := range maturities {
+		ctx = append(ctx, maturity+"_pass_rate", fmt.Sprintf("%.3f", summary.Maturity[maturity].passRate()))
+	}
+	logger.Info("hive run summary", ctx...)
+}
+
+// writeShellSummary hands the summary of a run finished within the shell container
+// over to the outer hive, which logs it once its own cleanup is done.
+func writeShellSummary(file string, summary *runSummary) error {
+	out, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, out, 0644)
+}
+
+// readShellSummary loads the summary handed over by the inner hive of a shell
+// container, returning nil if it never got to write one.
+func readShellSummary(file string) (*runSummary, error) {
+	blob, err := ioutil.ReadFile(file)
+	if err != nil || len(blob) == 0 {
+		return nil, err
+	}
+	summary := new(runSummary)
+	if err := json.Unmarshal(blob, summary); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
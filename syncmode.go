@@ -0,0 +1,53 @@
+// This file contains the utility methods for multiplying the validation and
+// benchmark matrix by the sync modes the clients are run in.
+
+package main
+
+import (
+	"strings"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// syncModeEnvvar is the environment variable selecting the sync and pruning
+// algorithm a client should run with.
+const syncModeEnvvar = "HIVE_NODETYPE"
+
+// clientSyncModes returns the sync modes requested via -sync-modes which a client
+// supports, or a single empty mode (i.e. client default) if none were requested.
+func clientSyncModes(client string, logger log15.Logger) ([]string, error) {
+	if *syncModes == "" {
+		return []string{""}, nil
+	}
+	meta, err := loadClientMetadata(client)
+	if err != nil {
+		return nil, err
+	}
+	var modes []string
+	for _, mode := range strings.Split(*syncModes, ",") {
+		if !meta.supportsSyncMode(mode) {
+			logger.Info("skipping unsupported sync mode", "mode", mode)
+			continue
+		}
+		modes = append(modes, mode)
+	}
+	return modes, nil
+}
+
+// syncModeKey returns the name a client's results are reported under when run in
+// the given sync mode.
+func syncModeKey(client string, mode string) string {
+	if mode == "" {
+		return client
+	}
+	return client + "/" + mode
+}
+
+// syncModeEnvs returns the environment variables to start a client container with
+// to run it in the given sync mode.
+func syncModeEnvs(mode string) map[string]string {
+	if mode == "" {
+		return nil
+	}
+	return map[string]string{syncModeEnvvar: mode}
+}
@@ -0,0 +1,165 @@
+// This file contains the utility methods for replaying recorded RPC traffic
+// against clients, detecting regressions in their responses.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// rpcTraceCheck is a recorded RPC trace a validator requests hive to replay
+// against every client, comparing the responses to the recorded ones.
+type rpcTraceCheck struct {
+	File   string   `json:"file"`             // Trace file within the validator folder
+	Ignore []string `json:"ignore,omitempty"` // Regexps of response field paths not to compare (e.g. timestamps)
+
+	ignore  []*regexp.Regexp
+	entries []rpcTraceEntry
+}
+
+// rpcTraceEntry is a single recorded RPC request along with its response.
+type rpcTraceEntry struct {
+	Method string          `json:"method"`           // RPC method called
+	Params []interface{}   `json:"params,omitempty"` // Parameters the method was called with
+	Result json.RawMessage `json:"result,omitempty"` // Recorded result of the call
+	Error  string          `json:"error,omitempty"`  // Recorded error message of the call, if it failed
+}
+
+// traceMismatch is a single field of a replayed RPC response that differs from
+// the recorded one.
+type traceMismatch struct {
+	Index    int    `json:"index"`    // Position of the request within the trace
+	Method   string `json:"method"`   // RPC method whose response differed
+	Params   string `json:"params"`   // Parameters of the request, JSON encoded
+	Path     string `json:"path"`     // Path of the differing field within the response
+	Expected string `json:"expected"` // Recorded value of the field (or missing)
+	Actual   string `json:"actual"`   // Value of the field returned by the client (or missing)
+}
+
+// load reads the recorded trace from a validator folder and compiles the ignored
+// field patterns.
+func (t *rpcTraceCheck) load(dir string) error {
+	for _, pattern := range t.Ignore {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid ignore pattern: %v", err)
+		}
+		t.ignore = append(t.ignore, re)
+	}
+	blob, err := ioutil.ReadFile(filepath.Join(dir, t.File))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(blob, &t.entries); err != nil {
+		return fmt.Errorf("invalid RPC trace: %v", err)
+	}
+	return nil
+}
+
+// replayTrace issues all the recorded requests of a trace against a client and
+// compares the responses field by field against the recorded ones.
+func replayTrace(ip string, trace *rpcTraceCheck, logger log15.Logger) []traceMismatch {
+	var mismatches []traceMismatch
+	for i, entry := range trace.entries {
+		params, _ := json.Marshal(entry.Params)
+
+		// Issue the request and flatten both the recorded and actual responses
+		expected, actual := make(map[string]string), make(map[string]string)
+		if entry.Error != "" {
+			expected["error"] = entry.Error
+		} else if err := flattenResponse(expected, entry.Result); err != nil {
+			logger.Warn("invalid recorded RPC response", "index", i, "method", entry.Method, "error", err)
+			continue
+		}
+		blob, err := callRPC(ip, entry.Method, entry.Params...)
+		if err != nil {
+			actual["error"] = err.Error()
+		} else if err := flattenResponse(actual, blob); err != nil {
+			actual["error"] = err.Error()
+		}
+		// Report all the differing fields not explicitly ignored
+		paths := make(map[string]bool)
+		for path := range expected {
+			paths[path] = true
+		}
+		for path := range actual {
+			paths[path] = true
+		}
+		sorted := make([]string, 0, len(paths))
+		for path := range paths {
+			if !trace.ignored(path) {
+				sorted = append(sorted, path)
+			}
+		}
+		sort.Strings(sorted)
+
+		for _, path := range sorted {
+			want, ok := expected[path]
+			if !ok {
+				want = "missing"
+			}
+			have, ok := actual[path]
+			if !ok {
+				have = "missing"
+			}
+			if want != have {
+				logger.Error("client RPC response mismatched trace", "index", i, "method", entry.Method, "path", path, "expected", want, "actual", have)
+				mismatches = append(mismatches, traceMismatch{Index: i, Method: entry.Method, Params: string(params), Path: path, Expected: want, Actual: have})
+			}
+		}
+	}
+	return mismatches
+}
+
+// ignored checks whether a response field path matches any of the ignore patterns.
+func (t *rpcTraceCheck) ignored(path string) bool {
+	for _, re := range t.ignore {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// flattenResponse decodes an RPC response and records the JSON encoded value of
+// every leaf field within it, keyed by its path.
+func flattenResponse(fields map[string]string, blob json.RawMessage) error {
+	var value interface{}
+	if len(blob) > 0 {
+		if err := json.Unmarshal(blob, &value); err != nil {
+			return err
+		}
+	}
+	flattenValue(fields, "$", value)
+	return nil
+}
+
+// flattenValue walks a decoded JSON value and records its leaf fields.
+func flattenValue(fields map[string]string, path string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			fields[path] = "{}"
+		}
+		for key, field := range v {
+			flattenValue(fields, path+"."+key, field)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			fields[path] = "[]"
+		}
+		for i, elem := range v {
+			flattenValue(fields, fmt.Sprintf("%s[%d]", path, i), elem)
+		}
+	default:
+		blob, _ := json.Marshal(v)
+		fields[path] = string(blob)
+	}
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
@@ -20,6 +22,20 @@ type validationResult struct {
 	Success bool      `json:"success"`         // Whether the entire validation succeeded
 	Error   error     `json:"error,omitempty"` // Potential hive failure during validation
 
+	Skipped       bool     `json:"skipped,omitempty"`       // Whether the validation was skipped via -test-skip
+	SyncMode      string   `json:"syncMode,omitempty"`      // Sync mode the client ran in, if explicitly requested
+	TruncatedLogs []string `json:"truncatedLogs,omitempty"` // Captured logs that exceeded the size cap and lost their heads
+	ClientLog     string   `json:"clientLog,omitempty"`     // Client log exported into -logdir, if any
+
+	Timeout time.Duration `json:"timeout,omitempty"` // Effective timeout of the validator, scaled for the client (ns, none if unbounded)
+
+	Logs        []logAssertionResult `json:"logs,omitempty"`        // Outcomes of any client log assertions
+	Divergence  *consensusDivergence `json:"divergence,omitempty"`  // First block the client's chain diverged from the others
+	SchemaDiffs []schemaDiff         `json:"schemaDiffs,omitempty"` // Structural differences of the client's RPC responses
+	Trace       []traceMismatch      `json:"trace,omitempty"`       // Differences of the client's RPC responses from the recorded trace
+
+	chain   []chainBlock    // Chain imported by the client, if consensus cross checking was requested
+	schemas []responseShape // RPC response structures, if schema cross checking was requested
 }
 
 type validationResultSummary struct {
@@ -28,8 +44,9 @@ type validationResultSummary struct {
 }
 
 // validateClients runs a batch of validation tests matched by validatorPattern
-// against all clients matching clientPattern.
-func validateClients(daemon *docker.Client, clientPattern, validatorPattern string, overrides []string, cacher *buildCacher) (map[string]map[string]*validationResult, error) {
+// against all clients matching clientPattern. Every result is passed to onResult
+// as soon as it is final.
+func validateClients(daemon *dockerClient, clientPattern, validatorPattern string, overrides []string, cacher *buildCacher, onResult resultHook) (map[string]map[string]*validationResult, error) {
 
 	// Build all the clients matching the validation pattern
 	log15.Info("building clients for validation", "pattern", clientPattern)
@@ -38,50 +55,164 @@ func validateClients(daemon *docker.Client, clientPattern, validatorPattern stri
 		return nil, err
 	}
 	// Build all the validators known to the test harness
-	log15.Info("building validators for testing", "pattern", validatorPattern)
-	validators, err := buildValidators(daemon, validatorPattern, cacher)
+	log15.Info("building validators for testing", "pattern", validatorPattern, "skip", *testSkipPattern)
+	validators, skipped, err := buildValidators(daemon, validatorPattern, *testSkipPattern, cacher)
 	if err != nil {
 		return nil, err
 	}
 	// Iterate over all client and validator combos and cross-execute them
-	results := make(map[string]map[string]*validationResult)
+	var (
+		results = make(map[string]map[string]*validationResult)
+		lock    sync.Mutex // Protects the results from concurrent validations
+		metas   = make(map[string]*testMetadata)
+		logdirs = make(map[string]string)
+		jobs    []func() error
+	)
+	// Results of validators cross checking their clients are only final once all
+	// of them finished, the others as soon as their validation did
+	crossChecked := func(meta *testMetadata) bool {
+		return meta.Consensus || meta.Schema != nil
+	}
+	finish := func(key string, validator string, result *validationResult) {
+		client := strings.TrimSuffix(key, "/"+result.SyncMode)
+		clientdir := filepath.Join(logdirs[validator], strings.Replace(client, string(filepath.Separator), "_", -1), result.SyncMode)
 
+		var err error
+		sources, _ := filepath.Glob(filepath.Join(clientdir, "client.log"))
+		if result.ClientLog, err = exportTestLogs(key, validator, result.Success, sources); err != nil {
+			log15.Error("failed to export client logs", "client", key, "validator", validator, "error", err)
+		}
+		recordTest("validator", result.Success, result.End.Sub(result.Start))
+		onResult("validator", key, validator, result.Success, result.End.Sub(result.Start), result)
+	}
+	// Record the skipped validators against every selected client, so the reports
+	// show them as deliberately not run instead of omitting them
+	for _, validator := range skipped {
+		for client := range clients {
+			if !selected("validator", validator, client) {
+				continue
+			}
+			logger := log15.New("client", client, "validator", validator)
+
+			modes, err := clientSyncModes(client, logger)
+			if err != nil {
+				return nil, err
+			}
+			for _, mode := range modes {
+				key := syncModeKey(client, mode)
+				if _, in := results[key]; !in {
+					results[key] = make(map[string]*validationResult)
+				}
+				now := time.Now()
+				results[key][validator] = &validationResult{Start: now, End: now, Skipped: true, SyncMode: mode}
+				onResult("validator", key, validator, false, 0, results[key][validator])
+			}
+			logger.Info("validation skipped")
+		}
+	}
 	for validator, validatorImage := range validators {
+		meta, err := loadTestMetadata("validators", validator)
+		if err != nil {
+			return nil, err
+		}
+		metas[validator] = meta
 
 		logdir, err := makeTestOutputDirectory(validator, "validator", clients)
 		if err != nil {
 			return nil, err
 		}
+		logdirs[validator] = logdir
 		for client, clientImage := range clients {
+			if !selected("validator", validator, client) {
+				continue
+			}
+			validator, validatorImage, client, clientImage := validator, validatorImage, client, clientImage
 
-			logger := log15.New("client", client, "validator", validator)
+			jobs = append(jobs, func() error {
+				logger := log15.New("client", client, "validator", validator)
 
-			result := validate(daemon, clientImage, validatorImage, overrides, logger, filepath.Join(logdir, strings.Replace(client, string(filepath.Separator), "_", -1)))
-			if result.Success {
-				logger.Info("validation passed", "time", result.End.Sub(result.Start))
-			} else {
-				logger.Error("validation failed", "time", result.End.Sub(result.Start))
-			}
+				modes, err := clientSyncModes(client, logger)
+				if err != nil {
+					return err
+				}
+				cmeta, err := loadClientMetadata(client)
+				if err != nil {
+					return err
+				}
+				// Validators only run bounded if they explicitly declared a timeout
+				var timeout time.Duration
+				if meta.timeout != 0 {
+					timeout = cmeta.timeout(meta.timeout)
+				}
+				for _, mode := range modes {
+					logger := logger
+					clientdir := filepath.Join(logdir, strings.Replace(client, string(filepath.Separator), "_", -1))
+					if mode != "" {
+						logger = logger.New("syncmode", mode)
+						clientdir = filepath.Join(clientdir, mode)
+					}
+					result := validate(daemon, clientImage, validatorImage, meta, overrides, syncModeEnvs(mode), timeout, logger, clientdir)
+					result.SyncMode = mode
+					result.TruncatedLogs = truncatedLogsIn(clientdir)
+					if result.Success {
+						logger.Info("validation passed", "time", result.End.Sub(result.Start))
+					} else {
+						logger.Error("validation failed", "time", result.End.Sub(result.Start))
+					}
+
+					key := syncModeKey(client, mode)
+					lock.Lock()
+					if _, in := results[key]; !in {
+						results[key] = make(map[string]*validationResult)
+					}
+					results[key][validator] = result
+					lock.Unlock()
 
-			if _, in := results[client]; !in {
-				results[client] = make(map[string]*validationResult)
+					if !crossChecked(meta) {
+						finish(key, validator, result)
+					}
+				}
+				return nil
+			})
+		}
+	}
+	if err := runParallel(*parallelFlag, jobs); err != nil {
+		return nil, err
+	}
+	// Cross check the clients of validators requesting it, now that all finished
+	for validator, meta := range metas {
+		// If requested, make sure all clients imported the exact same chain
+		if meta.Consensus {
+			crossCheckChains(results, validator, log15.New("validator", validator))
+		}
+		// If requested, make sure all clients return structurally identical RPC responses
+		if meta.Schema != nil {
+			crossCheckSchemas(results, validator, meta.Schema, log15.New("validator", validator))
+		}
+	}
+	// Finalize the results of the cross checked validators
+	for key, tests := range results {
+		for validator, result := range tests {
+			if result.Skipped || !crossChecked(metas[validator]) {
+				continue
 			}
-			results[client][validator] = result
+			finish(key, validator, result)
 		}
 	}
 	return results, nil
 }
 
-func validate(daemon *docker.Client, client, validator string, overrides []string, logger log15.Logger, logdir string) *validationResult {
+func validate(daemon *dockerClient, client, validator string, meta *testMetadata, overrides []string, envs map[string]string, timeout time.Duration, logger log15.Logger, logdir string) *validationResult {
 	logger.Info("running client validation")
 	result := &validationResult{
-		Start: time.Now(),
+		Start:   time.Now(),
+		Timeout: timeout,
 	}
 	defer func() { result.End = time.Now() }()
 
 	// Create the client container and make sure it's cleaned up afterwards
 	logger.Debug("creating client container")
-	cc, err := createClientContainer(daemon, client, validator, nil, overrides, nil)
+	cc, err := createClientContainer(daemon, client, validator, nil, overrides, envs, "")
 	if err != nil {
 		logger.Error("failed to create client", "error", err)
 		result.Error = err
@@ -98,7 +229,7 @@ func validate(daemon *docker.Client, client, validator string, overrides []strin
 
 	// Start the client container and retrieve its IP address for the validator
 	clogger.Debug("running client container")
-	cwaiter, err := runContainer(daemon, cc.ID, clogger, filepath.Join(logdir, "client.log"), false)
+	cwaiter, err := runContainer(daemon, cc.ID, clogger, filepath.Join(logdir, "client.log"), false, clientLimits)
 	if err != nil {
 		clogger.Error("failed to run client", "error", err)
 		result.Error = err
@@ -125,8 +256,11 @@ func validate(daemon *docker.Client, client, validator string, overrides []strin
 			return result
 		}
 		if !c.State.Running {
-			clogger.Error("client container terminated")
+			clogger.Error("client container terminated", "oomkilled", c.State.OOMKilled)
 			result.Error = errors.New("terminated unexpectedly")
+			if c.State.OOMKilled {
+				result.Error = errClientOOMKilled
+			}
 			return result
 		}
 		// Container seems to be alive, check whether the RPC is accepting connections
@@ -139,12 +273,29 @@ func validate(daemon *docker.Client, client, validator string, overrides []strin
 
 		time.Sleep(100 * time.Millisecond)
 	}
+	// If chains are cross checked between clients, retrieve the imported one
+	if meta.Consensus {
+		if result.chain, err = fetchChain(cip); err != nil {
+			clogger.Error("failed to retrieve client chain", "error", err)
+			result.Error = err
+			return result
+		}
+		clogger.Debug("retrieved client chain", "blocks", len(result.chain))
+	}
+	// If RPC responses are cross checked between clients, retrieve their structures
+	if meta.Schema != nil {
+		result.schemas = fetchSchemas(cip, meta.Schema, clogger)
+	}
+	// If a recorded RPC trace was requested, replay it before the validator runs
+	if meta.Trace != nil {
+		result.Trace = replayTrace(cip, meta.Trace, clogger)
+	}
 	// Create the validator container and make sure it's cleaned up afterwards
 	logger.Debug("creating validator container")
 	vc, err := daemon.CreateContainer(docker.CreateContainerOptions{
 		Config: &docker.Config{
 			Image: validator,
-			Env:   []string{"HIVE_CLIENT_IP=" + cip, "HIVE_CLIENT_ID=" + cc.ID, "HIVE_DOCKER_HOST_ALIAS=" + *dockerHostAlias},
+			Env:   append([]string{"HIVE_CLIENT_IP=" + cip, "HIVE_CLIENT_ID=" + cc.ID, "HIVE_DOCKER_HOST_ALIAS=" + *dockerHostAlias}, globalSetupEnvs()...),
 		},
 	})
 	if err != nil {
@@ -169,7 +320,7 @@ func validate(daemon *docker.Client, client, validator string, overrides []strin
 
 	// Start the tester container and wait until it finishes
 	vlogger.Debug("running validator container")
-	vwaiter, err := runContainer(daemon, vc.ID, vlogger, filepath.Join(logdir, "validator.log"), false)
+	vwaiter, err := runContainer(daemon, vc.ID, vlogger, filepath.Join(logdir, "validator.log"), false, nil)
 	if err != nil {
 		vlogger.Error("failed to run validator", "error", err)
 		result.Error = err
@@ -182,7 +333,28 @@ func validate(daemon *docker.Client, client, validator string, overrides []strin
 		return result
 	}
 	vlogger.Info("validator ip address:" + v.NetworkSettings.IPAddress)
-	vwaiter.Wait()
+
+	// Wait for the validator to finish, stopping it if it runs past its timeout
+	done := make(chan struct{})
+	go func() {
+		vwaiter.Wait()
+		close(done)
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case <-done:
+	case <-expired:
+		vlogger.Error("validator timed out, stopping", "timeout", timeout)
+		if err := daemon.StopContainer(vc.ID, 0); err != nil {
+			vlogger.Error("failed to stop validator", "error", err)
+		}
+		<-done
+		result.Error = fmt.Errorf("timed out after %v", timeout)
+		return result
+	}
 
 	// Retrieve the exist status to report pass of fail
 	v, err = daemon.InspectContainer(vc.ID)
@@ -193,5 +365,31 @@ func validate(daemon *docker.Client, client, validator string, overrides []strin
 	}
 
 	result.Success = v.State.ExitCode == 0
+
+	// If the client was killed for exceeding its memory limit, report that instead
+	if err := checkOOMKilled(daemon, cc.ID); err != nil {
+		clogger.Error("client container killed by the OOM killer")
+		result.Error = err
+		result.Success = false
+		return result
+	}
+
+	// If the validator declared client log assertions, check them too
+	if meta.Logs != nil {
+		log, err := ioutil.ReadFile(filepath.Join(logdir, "client.log"))
+		if err != nil {
+			clogger.Error("failed to read client logs", "error", err)
+			result.Error = err
+			result.Success = false
+			return result
+		}
+		ok, checks := meta.Logs.check(log)
+		if !ok {
+			clogger.Error("client log assertions failed")
+		}
+		result.Logs = checks
+		result.Success = result.Success && ok
+	}
+	result.Success = result.Success && len(result.Trace) == 0
 	return result
 }
@@ -0,0 +1,129 @@
+// This file contains the utility methods for posting a compact summary of a hive
+// run to a webhook (e.g. Slack) once all the tests finished.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// webhookAttempts is the number of times delivering a webhook summary is tried
+// before giving up, doubling the wait between each attempt.
+const webhookAttempts = 3
+
+// maxWebhookBackoff caps the wait between two webhook delivery attempts.
+const maxWebhookBackoff = 10 * time.Second
+
+// webhookSignatureHeader is the HTTP header carrying the HMAC-SHA256 signature of
+// the payload, if a -webhook-secret was given.
+const webhookSignatureHeader = "X-Hive-Signature"
+
+// notifyWebhook posts the summary of a finished run to the -webhook-url, if one was
+// requested. Delivery failures are only warned about, the results are already all
+// persisted and the outcome of the run must not depend on the webhook.
+func notifyWebhook(results *resultSet, elapsed time.Duration, fail error) {
+	if *webhookURL == "" {
+		return
+	}
+	summary := summariseRun(results, *resultURL)
+	summary.finish(elapsed, fail)
+
+	body, err := webhookBody(summary, *webhookTemplate)
+	if err != nil {
+		log15.Warn("failed to assemble webhook summary", "error", err)
+		return
+	}
+	if err := postWebhook(*webhookURL, body, *webhookTimeout, *webhookSecret); err != nil {
+		log15.Warn("failed to post webhook summary", "error", err)
+	}
+}
+
+// webhookBody assembles the payload to post to the webhook. Without a template the
+// run summary is sent as JSON, otherwise the template file is executed against it
+// (e.g. to wrap a message into the format expected by Slack).
+func webhookBody(summary *runSummary, templateFile string) ([]byte, error) {
+	if templateFile == "" {
+		return json.Marshal(summary)
+	}
+	tmpl, err := template.New(filepath.Base(templateFile)).Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			blob, err := json.Marshal(v)
+			return string(blob), err
+		},
+	}).ParseFiles(templateFile)
+	if err != nil {
+		return nil, err
+	}
+	body := new(bytes.Buffer)
+	if err := tmpl.Execute(body, summary); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
+
+// webhookSignature computes the hex encoded HMAC-SHA256 of a payload, allowing the
+// receiver to verify that it originates from a hive run knowing the secret.
+func webhookSignature(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook delivers a payload to a webhook, retrying on network failures and
+// non-2xx responses until the timeout (spanning all attempts) expires. A non-empty
+// secret signs the payload.
+func postWebhook(url string, body []byte, timeout time.Duration, secret string) error {
+	var (
+		deadline time.Time
+		delay    = newBackoff(time.Second, maxWebhookBackoff)
+		err      error
+	)
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			if !deadline.IsZero() && time.Until(deadline) <= delay.next() {
+				break
+			}
+			log15.Warn("retrying webhook delivery", "attempt", attempt, "error", err)
+			delay.wait()
+		}
+		var req *http.Request
+		if req, err = http.NewRequest("POST", url, bytes.NewReader(body)); err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if secret != "" {
+			req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(body, secret))
+		}
+		client := new(http.Client)
+		if !deadline.IsZero() {
+			client.Timeout = time.Until(deadline)
+		}
+		var res *http.Response
+		if res, err = client.Do(req); err != nil {
+			continue
+		}
+		reply, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode >= 200 && res.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("webhook responded with %s: %s", res.Status, bytes.TrimSpace(reply))
+	}
+	return err
+}